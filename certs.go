@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+// watchKeyPair reloads kp on SIGHUP and whenever its files change.
+func watchKeyPair(kp *ws.KeyPair) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if config.TLSReload > 0 {
+		ticker := time.NewTicker(config.TLSReload)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			if err := kp.Reload(); err != nil {
+				logf("failed to reload TLS certificate: %v", err)
+				continue
+			}
+			logf("reloaded TLS certificate")
+		case <-tick:
+			modified, err := kp.ReloadIfModified()
+			if err != nil {
+				logf("failed to reload TLS certificate: %v", err)
+				continue
+			}
+			if modified {
+				logf("reloaded modified TLS certificate")
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Flags starting each direction of a compressed stream.
+const (
+	flagPlain   = 0
+	flagDeflate = 1
+)
+
+// compressor is a connection able to stop compressing what is written.
+type compressor interface {
+	EnableWriteCompression(enable bool)
+}
+
+// compressConn compresses the plaintext of a connection whose ends agreed to
+// compress it, before it is encrypted. Each direction starts with a flag
+// telling whether the rest of it is a deflate stream, so that either end may
+// leave what it writes uncompressed.
+type compressConn struct {
+	net.Conn
+	level int
+
+	r io.Reader // of the rest of the stream read, nil until the flag was read
+
+	started bool          // the flag was written
+	plain   bool          // what is written is not compressed
+	fw      *flate.Writer // nil unless compressing
+	buf     bytes.Buffer  // written but not sent yet
+}
+
+// compressStream returns c, the plaintext of the stream conn carries,
+// compressing what is written at -compress-level if both ends of conn
+// agreed to.
+func compressStream(c, conn net.Conn) net.Conn {
+	if !transport.Compressed(conn) {
+		return c
+	}
+	return newCompressConn(c)
+}
+
+func newCompressConn(c net.Conn) *compressConn {
+	return &compressConn{Conn: c, level: config.CompressLevel}
+}
+
+// compressedCarrier is the plaintext of a connection whose ends agreed to
+// compress the streams multiplexed over it, each on its own so that
+// -compress-skip applies per target.
+type compressedCarrier struct{ net.Conn }
+
+func (compressedCarrier) Compressed() bool { return true }
+
+// muxCarrier returns c, the plaintext of the multiplexed connection conn,
+// reporting whether both ends of conn agreed to compress.
+func muxCarrier(c, conn net.Conn) net.Conn {
+	if !transport.Compressed(conn) {
+		return c
+	}
+	return compressedCarrier{c}
+}
+
+func (c *compressConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		var flag [1]byte
+		if _, err := io.ReadFull(c.Conn, flag[:]); err != nil {
+			return 0, err
+		}
+		switch flag[0] {
+		case flagPlain:
+			c.r = c.Conn
+		case flagDeflate:
+			c.r = flate.NewReader(c.Conn)
+		default:
+			return 0, errors.New("invalid compression flag")
+		}
+	}
+	return c.r.Read(b)
+}
+
+// EnableWriteCompression turns compression of what is written on or off.
+// It has no effect once something was written.
+func (c *compressConn) EnableWriteCompression(enable bool) {
+	if !c.started {
+		c.plain = !enable
+	}
+}
+
+func (c *compressConn) Write(b []byte) (int, error) {
+	if !c.started {
+		c.started = true
+		if c.plain {
+			c.buf.WriteByte(flagPlain)
+		} else {
+			c.buf.WriteByte(flagDeflate)
+			c.fw, _ = flate.NewWriter(&c.buf, c.level) // the level was checked
+		}
+	}
+
+	switch {
+	case c.fw != nil:
+		c.fw.Write(b)
+		c.fw.Flush() // the peer needs all written so far
+	case c.buf.Len() == 0:
+		return c.Conn.Write(b)
+	default:
+		c.buf.Write(b)
+	}
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flush sends what was written but not sent yet.
+func (c *compressConn) flush() error {
+	_, err := c.Conn.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// CloseWrite ends the deflate stream, if any, and closes the writing side of
+// the connection.
+func (c *compressConn) CloseWrite() error {
+	if c.fw != nil {
+		c.fw.Close()
+		c.fw = nil
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	return closeWrite(c.Conn)
+}
+
+// parsePorts returns the set of ports in the comma-separated list s.
+func parsePorts(s string) map[string]bool {
+	ports := make(map[string]bool)
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ports[p] = true
+		}
+	}
+	return ports
+}
+
+// compressFor turns off compression of c for targets on one of the ports of
+// -compress-skip, whose traffic is usually compressed or encrypted already.
+func compressFor(c net.Conn, tgt socks.Addr) {
+	cc, ok := c.(compressor)
+	if !config.Compress || !ok {
+		return
+	}
+	_, port, err := net.SplitHostPort(tgt.String())
+	if err == nil && config.CompressSkip[port] {
+		cc.EnableWriteCompression(false)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// countingConn counts the bytes read from its connection.
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// readerConn is a connection read through r.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func TestCompressWS(t *testing.T) {
+	users := testUsers(t)
+	ciph := users.byName[""].ciph.(shadowaead.Cipher)
+	payload := bytes.Repeat([]byte(`{"id": 42, "name": "value", "tags": ["a", "b"]} `), 10000)
+	config.CompressLevel = 1
+	defer func() { config.Compress, config.CompressLevel = false, 0 }()
+
+	for _, compress := range []bool{false, true} {
+		config.Compress = compress
+		l, err := transport.Listen("ws://127.0.0.1:0/p", users.keys())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDialer("ws://dk@" + l.Addr().String() + "/p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := d.Dial(transport.ModeStream)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			c := compressStream(shadowaead.NewConn(conn, ciph), conn)
+			c.Write(payload)
+			c.(interface{ CloseWrite() error }).CloseWrite()
+			c.Read(make([]byte, 1)) // until the server is done
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transport.Compressed(conn) != compress {
+			t.Fatalf("-compress %v: compression agreed %v", compress, !compress)
+		}
+		// decrypt without the replay check, which the client's salt is in
+		wire := &countingConn{Conn: conn}
+		salt := make([]byte, ciph.SaltSize())
+		if _, err := io.ReadFull(wire, salt); err != nil {
+			t.Fatal(err)
+		}
+		aead, err := ciph.Decrypter(salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := compressStream(&readerConn{conn, shadowaead.NewReader(wire, aead)}, conn)
+		b, err := io.ReadAll(c)
+		if err != nil || !bytes.Equal(b, payload) {
+			t.Fatalf("-compress %v: read %d bytes, %v", compress, len(b), err)
+		}
+		n := atomic.LoadInt64(&wire.n)
+		if compress != (n < int64(len(payload)/10)) {
+			t.Errorf("-compress %v: %d bytes on the wire for %d", compress, n, len(payload))
+		}
+		conn.Close()
+		l.Close()
+	}
+}
+
+func TestCompressSkip(t *testing.T) {
+	config.Compress, config.CompressLevel = true, 1
+	config.CompressSkip = parsePorts("443")
+	defer func() { config.Compress, config.CompressLevel, config.CompressSkip = false, 0, nil }()
+
+	for _, tc := range []struct {
+		target string
+		flag   byte
+	}{
+		{"example.com:80", flagDeflate},
+		{"example.com:443", flagPlain},
+	} {
+		a, b := net.Pipe()
+		c := compressStream(a, compressedCarrier{a})
+		compressFor(c, socks.ParseAddr(tc.target))
+		go func() {
+			c.Write([]byte("hello"))
+			c.(interface{ CloseWrite() error }).CloseWrite()
+			a.Close()
+		}()
+		flag := make([]byte, 1)
+		io.ReadFull(b, flag)
+		if flag[0] != tc.flag {
+			t.Errorf("%s: flag %d, want %d", tc.target, flag[0], tc.flag)
+		}
+		// the peer reads either
+		r := compressStream(&readerConn{b, io.MultiReader(bytes.NewReader(flag), b)}, compressedCarrier{b})
+		if got, _ := io.ReadAll(r); string(got) != "hello" {
+			t.Errorf("%s: read %q", tc.target, got)
+		}
+		b.Close()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Time to wait for the first payload to send it along with the target
+// address in the upgrade request.
+const earlyDataWait = 20 * time.Millisecond
+
+// earlyConn holds back what is written to it until Connect dials the server
+// with the bytes written so far as early data.
+type earlyConn struct {
+	net.Conn // nil until connected
+	dial     func(early []byte) (net.Conn, error)
+	buf      bytes.Buffer
+}
+
+func newEarlyConn(dial func(early []byte) (net.Conn, error)) *earlyConn {
+	return &earlyConn{dial: dial}
+}
+
+// Connect dials the server with the buffered bytes as early data.
+func (c *earlyConn) Connect() error {
+	conn, err := c.dial(c.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	c.Conn = conn
+	c.buf.Reset()
+	return nil
+}
+
+func (c *earlyConn) Write(b []byte) (int, error) {
+	if c.Conn == nil {
+		return c.buf.Write(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *earlyConn) CloseWrite() error {
+	if c.Conn == nil {
+		return errors.ErrUnsupported
+	}
+	return closeWrite(c.Conn)
+}
+
+func (c *earlyConn) Close() error {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+// dialEarly connects to the server of d sending the target address and,
+// with -early-data, the first payload of c as early data of the upgrade
+// request.
+func dialEarly(d transport.EarlyDialer, shadow func(net.Conn) net.Conn, c net.Conn, tgt socks.Addr) (net.Conn, error) {
+	ec := newEarlyConn(func(early []byte) (net.Conn, error) {
+		return d.DialEarly(transport.ModeStream, early)
+	})
+	rc := shadow(ec)
+	if _, err := rc.Write(tgt); err != nil {
+		return nil, err
+	}
+	if config.EarlyData > 0 {
+		b, err := readEarly(c, config.EarlyData)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > 0 {
+			if _, err := rc.Write(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := ec.Connect(); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// readEarly reads what c sends within earlyDataWait, up to n bytes. It
+// returns no data and no error if c sends nothing in time.
+func readEarly(c net.Conn, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	c.SetReadDeadline(time.Now().Add(earlyDataWait))
+	defer c.SetReadDeadline(time.Time{})
+	n, err := c.Read(buf)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return nil, nil
+	}
+	return buf[:n], err
+}
@@ -1,10 +1,17 @@
 module github.com/shadowsocks/go-shadowsocks2
 
-go 1.12
+go 1.24
 
 require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/quic-go/quic-go v0.59.1
 	github.com/riobard/go-bloom v0.0.0-20200213042214-218e1707c495
-	golang.org/x/crypto v0.0.0-20200128174031-69ecbb4d6d5d
+	golang.org/x/crypto v0.41.0
+)
+
+require (
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
 )
 
 replace (
@@ -0,0 +1,225 @@
+package h2
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Size of the chunks read from the body of the peer.
+const readBufSize = 16 * 1024
+
+// Conn is a net.Conn carrying a byte stream over an HTTP/2 stream: the
+// request body carries the bytes of the client and the response body those
+// of the server.
+//
+// Read deadlines interrupt pending reads. Write deadlines only fail writes
+// started after they expire, since a write blocked by flow control cannot
+// be interrupted without resetting the stream.
+type Conn struct {
+	body  io.ReadCloser // from the peer
+	w     io.Writer     // to the peer
+	flush func()        // sends what w buffers, if not nil
+	user  string
+	mode  string
+	laddr net.Addr
+	raddr net.Addr
+
+	reads   chan readResult // chunks read from body by pump
+	rmu     sync.Mutex      // serializes readers
+	pending []byte          // rest of the chunk being consumed by Read
+	rerr    error           // error ending body, once pending is consumed
+
+	wmu sync.Mutex // serializes writers
+
+	rdl, wdl deadline
+
+	closeOnce sync.Once
+	closeW    func() error  // ends the stream of the local side, if not nil
+	onClose   func()        // called once closed, if not nil
+	done      chan struct{} // closed by Close
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+type readResult struct {
+	b   []byte
+	err error
+}
+
+func newConn(body io.ReadCloser, w io.Writer) *Conn {
+	c := &Conn{
+		body:  body,
+		w:     w,
+		reads: make(chan readResult),
+		done:  make(chan struct{}),
+	}
+	c.rdl.cancel = make(chan struct{})
+	c.wdl.cancel = make(chan struct{})
+	if f, ok := w.(http.Flusher); ok {
+		c.flush = f.Flush
+	}
+	go c.pump()
+	return c
+}
+
+// pump reads the body of the peer for Read, which may then give up on
+// deadlines without losing data.
+func (c *Conn) pump() {
+	for {
+		b := make([]byte, readBufSize)
+		n, err := c.body.Read(b)
+		select {
+		case c.reads <- readResult{b[:n], err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read reads the stream of the peer.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		select {
+		case r := <-c.reads:
+			c.pending, c.rerr = r.b, r.err
+		case <-c.rdl.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, io.ErrClosedPipe
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends p to the peer.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	case <-c.wdl.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	n, err := c.w.Write(p)
+	if err == nil && c.flush != nil {
+		c.flush()
+	}
+	return n, err
+}
+
+// CloseWrite ends the request body of a client connection while the
+// response goes on. A server cannot end its side before the request is
+// over, so CloseWrite fails on server connections.
+func (c *Conn) CloseWrite() error {
+	if c.closeW == nil {
+		return errors.ErrUnsupported
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.closeW()
+}
+
+// Close ends the stream in both directions.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.closeW != nil {
+			c.closeW()
+		}
+		c.body.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+// User returns the user the server authorized the connection for.
+func (c *Conn) User() string { return c.user }
+
+// Mode returns the mode the client asked for in ModeHeader.
+func (c *Conn) Mode() string { return c.mode }
+
+func (c *Conn) LocalAddr() net.Addr  { return c.laddr }
+func (c *Conn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.rdl.set(t)
+	c.wdl.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error  { c.rdl.set(t); return nil }
+func (c *Conn) SetWriteDeadline(t time.Time) error { c.wdl.set(t); return nil }
+
+// deadline is a channel closed when a settable time passes.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed once the deadline passed
+}
+
+// set sets the deadline to t, where the zero time means none.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to close cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed once the deadline passed.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
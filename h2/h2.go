@@ -0,0 +1,102 @@
+// Package h2 carries byte streams over HTTP/2. Each connection is a POST
+// request streaming the bytes of the client in its body while the response
+// body streams those of the server, so that the connections to a server
+// share one TLS connection.
+package h2
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// ModeHeader carries the mode of a connection, which the server echoes in
+// the response if it accepts it.
+const ModeHeader = "X-Mode"
+
+// A Dialer connects to an HTTP/2 server, multiplexing the connections over
+// one TLS connection.
+type Dialer struct {
+	// TLSConfig, Proxy and Header are as in ws.Dialer, Header being sent
+	// with every request.
+	TLSConfig *tls.Config
+	Proxy     *url.URL
+	Header    http.Header
+
+	once   sync.Once
+	client *http.Client
+}
+
+func (d *Dialer) init() {
+	t := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   d.TLSConfig,
+		ForceAttemptHTTP2: true,
+	}
+	if d.Proxy != nil {
+		t.Proxy = http.ProxyURL(d.Proxy)
+	}
+	d.client = &http.Client{Transport: t}
+}
+
+// Dial opens a connection to the server at urlStr (https://) in mode and
+// sends h with the request.
+func (d *Dialer) Dial(urlStr, mode string, h http.Header) (*Conn, error) {
+	d.once.Do(d.init)
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, urlStr, pr)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range d.Header {
+		req.Header[k] = v
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	if mode != "" {
+		req.Header.Set(ModeHeader, mode)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 || resp.Header.Get(ModeHeader) != mode {
+		resp.Body.Close()
+		pw.Close()
+		switch {
+		case resp.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("h2: bad status %s", resp.Status)
+		case resp.ProtoMajor != 2:
+			return nil, fmt.Errorf("h2: server speaks %s", resp.Proto)
+		}
+		return nil, fmt.Errorf("h2: server does not support mode %q", mode)
+	}
+
+	c := newConn(resp.Body, pw)
+	c.closeW = pw.Close
+	c.mode = mode
+	c.raddr = addr(req.URL.Host)
+	c.laddr = addr("")
+	return c, nil
+}
+
+// addr is the address of a stream, which is not a network connection of
+// its own.
+type addr string
+
+func (a addr) Network() string { return "h2" }
+func (a addr) String() string  { return string(a) }
+
+var _ net.Addr = addr("")
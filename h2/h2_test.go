@@ -0,0 +1,175 @@
+package h2
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	n int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.n, 1)
+	}
+	return c, err
+}
+
+// serve starts s on a loopback HTTP/2 server and returns the URL of s, a
+// dialer trusting it, the connections s accepts and the listener of the
+// server.
+func serve(t *testing.T, s *Server) (string, *Dialer, <-chan *Conn, *countingListener) {
+	conns := make(chan *Conn, 4)
+	s.Handler = func(c *Conn, _ string) {
+		t.Cleanup(func() { c.Close() })
+		conns <- c
+	}
+	ts := httptest.NewUnstartedServer(s)
+	l := &countingListener{Listener: ts.Listener}
+	ts.Listener = l
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	return ts.URL + s.Path, &Dialer{TLSConfig: &tls.Config{RootCAs: roots}}, conns, l
+}
+
+func TestStreamsShareConnection(t *testing.T) {
+	url, d, conns, l := serve(t, &Server{Path: "/tunnel"})
+
+	for i := 0; i < 3; i++ {
+		c, err := d.Dial(url, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		sc := <-conns
+		c.Write([]byte{byte('a' + i)})
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(sc, b); err != nil || b[0] != byte('a'+i) {
+			t.Fatalf("stream %d: read %q, %v", i, b, err)
+		}
+	}
+	if n := atomic.LoadInt32(&l.n); n != 1 {
+		t.Fatalf("%d TLS connections for 3 streams", n)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	url, d, conns, _ := serve(t, &Server{})
+	c, err := d.Dial(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := <-conns
+
+	c.Write([]byte("half"))
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(sc)
+	if err != nil || string(b) != "half" {
+		t.Fatalf("server read %q, %v", b, err)
+	}
+
+	// the response goes on, but cannot end before the handler returns
+	sc.Write([]byte("reply"))
+	if err := sc.CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("CloseWrite on the server: %v", err)
+	}
+	b = make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "reply" {
+		t.Fatalf("client read %q, %v", b, err)
+	}
+}
+
+func TestModes(t *testing.T) {
+	url, d, conns, _ := serve(t, &Server{Modes: []string{"udp"}})
+
+	c, err := d.Dial(url, "udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if sc := <-conns; sc.Mode() != "udp" || c.Mode() != "udp" {
+		t.Fatalf("modes %q and %q, want udp", sc.Mode(), c.Mode())
+	}
+	if _, err := d.Dial(url, "mux", nil); err == nil {
+		t.Fatal("unsupported mode accepted")
+	}
+}
+
+func TestAuthFallback(t *testing.T) {
+	decoy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Decoy", "1")
+		http.NotFound(w, r)
+	})
+	url, d, conns, _ := serve(t, &Server{
+		Auth:     ws.KeyAuth(map[string]string{"secret": "alice"}),
+		Fallback: decoy,
+	})
+
+	// refused clients see the decoy, like any other request
+	if _, err := d.Dial(url, "", ws.Auth("wrong", "")); err == nil {
+		t.Fatal("wrong key accepted")
+	}
+	d.once.Do(d.init)
+	resp, err := d.client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Decoy") == "" {
+		t.Fatal("GET request not handed to the fallback")
+	}
+
+	c, err := d.Dial(url, "", ws.Auth("secret", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if u := (<-conns).User(); u != "alice" {
+		t.Fatalf("user %q, want alice", u)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	url, d, conns, _ := serve(t, &Server{})
+	c, err := d.Dial(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := <-conns
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	// data the pump read meanwhile is not lost
+	sc.Write([]byte("x"))
+	c.SetReadDeadline(time.Time{})
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(c, b); err != nil || b[0] != 'x' {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,169 @@
+package h2
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+// Server accepts connections as POST requests over HTTP/2 with TLS.
+type Server struct {
+	// TLSConfig provides the certificate of the server. HTTP/2 is only
+	// negotiated over TLS.
+	TLSConfig *tls.Config
+
+	// Auth, Path, Fallback and RealIP are as in ws.Server, Path being
+	// where connections are accepted as POST requests.
+	Auth     func(username, password string) (user string, ok bool)
+	Path     string
+	Fallback http.Handler
+	RealIP   *ws.RealIP
+
+	// Modes are the modes the server supports besides the default one.
+	Modes []string
+
+	// Handler is called with each connection and the address of the
+	// client. The connection lasts until closed, even after Handler
+	// returns.
+	Handler func(conn *Conn, remoteAddr string)
+
+	mu      sync.Mutex
+	hs      *http.Server
+	conns   map[*Conn]struct{}
+	closing bool
+}
+
+// ServeHTTP accepts authorized HTTP/2 POST requests on s.Path as
+// connections and hands the rest to s.Fallback.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := s.Path
+	if path == "" {
+		path = "/"
+	}
+	if r.URL.Path == path && r.Method == http.MethodPost && r.ProtoMajor == 2 {
+		s.accept(w, r)
+		return
+	}
+	if s.Fallback != nil {
+		s.Fallback.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (s *Server) accept(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := s.RealIP.ClientIP(r)
+	user, ok := ws.Authorize(r, s.Auth)
+	if !ok {
+		log.Println("rejected unauthorized request from", remoteAddr)
+		if s.Fallback != nil {
+			s.Fallback.ServeHTTP(w, r)
+		} else {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+		return
+	}
+	mode := r.Header.Get(ModeHeader)
+	if !transport.Supports(s.Modes, mode) {
+		log.Printf("rejected unsupported mode %q from %s", mode, remoteAddr)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	conn := newConn(r.Body, w)
+	conn.user = user
+	conn.mode = mode
+	conn.raddr = addr(r.RemoteAddr)
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.laddr = la
+	} else {
+		conn.laddr = addr("")
+	}
+	if !s.track(conn) {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if mode != "" {
+		w.Header().Set(ModeHeader, mode)
+	}
+	w.WriteHeader(http.StatusOK)
+	if conn.flush != nil {
+		conn.flush()
+	}
+
+	s.Handler(conn, remoteAddr)
+
+	// the stream ends with the handler
+	select {
+	case <-conn.done:
+	case <-r.Context().Done():
+		conn.Close()
+	}
+	conn.wmu.Lock() // wait for a write in flight, w is invalid once returned
+	conn.wmu.Unlock()
+}
+
+// track adds conn to the open connections until it is closed. It reports
+// false if the server is shutting down.
+func (s *Server) track(conn *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	conn.onClose = func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}
+	return true
+}
+
+func (s *Server) server() *http.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hs == nil {
+		s.hs = &http.Server{Handler: s, TLSConfig: s.TLSConfig}
+	}
+	return s.hs
+}
+
+// Serve accepts TLS connections on l and serves HTTP requests with s. After
+// Shutdown it returns http.ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	return s.server().ServeTLS(l, "", "")
+}
+
+// Shutdown stops accepting connections and waits for the open ones to be
+// closed by their handlers. When ctx is done first, it resets the remaining
+// ones.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	err := s.server().Shutdown(ctx)
+	if err != nil {
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/BigSully/shadowsocks-ws/h2"
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+// h2Client is the transport.Dialer of HTTP/2 servers with URLs such as
+// h2://key@host:port/path. All its connections share one TLS connection.
+type h2Client struct {
+	url    string // https URL of the server
+	key    string
+	dialer *h2.Dialer
+}
+
+func dialH2(u *url.URL) (transport.Dialer, error) {
+	urlStr := fmt.Sprintf("https://%s%s", u.Host, u.Path)
+	tlsConfig, err := ws.ClientTLSConfig(config.TLSCA, config.TLSServerName, config.TLSInsecure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure dialer for %s: %v", urlStr, err)
+	}
+	proxy, err := clientProxy()
+	if err != nil {
+		return nil, err
+	}
+	d := &h2.Dialer{TLSConfig: tlsConfig, Proxy: proxy, Header: clientHeader()}
+	return &h2Client{url: urlStr, key: u.User.Username(), dialer: d}, nil
+}
+
+// Dial opens a stream to the server in mode.
+func (c *h2Client) Dial(mode string) (net.Conn, error) {
+	conn, err := c.dialer.Dial(c.url, mode, ws.Auth(c.key, ""))
+	if err != nil {
+		return nil, err
+	}
+	if mode == transport.ModePacket {
+		return transport.NewPacketConn(conn), nil
+	}
+	return conn, nil
+}
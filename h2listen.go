@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/BigSully/shadowsocks-ws/h2"
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+func init() {
+	transport.Register("h2", dialH2, listenH2)
+}
+
+// h2Listener is the transport.Listener of an HTTP/2 server.
+type h2Listener struct {
+	*transport.Queue
+	srv *h2.Server
+	l   net.Listener
+}
+
+func listenH2(u *url.URL, users map[string]string) (transport.Listener, error) {
+	if config.TLSCert == "" {
+		return nil, errors.New("h2:// needs -tls-cert and -tls-key")
+	}
+	kp, err := ws.LoadKeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	go watchKeyPair(kp)
+
+	srv := &h2.Server{
+		TLSConfig: kp.TLSConfig(),
+		Path:      u.Path,
+		Modes:     []string{transport.ModeMux, transport.ModePacket},
+	}
+	if config.Decoy != "" {
+		fallback, err := ws.Decoy(config.Decoy)
+		if err != nil {
+			return nil, err
+		}
+		srv.Fallback = fallback
+	}
+	if len(users) > 0 {
+		srv.Auth = ws.KeyAuth(users)
+	} else {
+		logf("no client keys configured, accepting all HTTP/2 clients")
+	}
+	if config.TrustedProxies != nil || len(config.RealIPHeaders) > 0 {
+		srv.RealIP = &ws.RealIP{Trusted: config.TrustedProxies, Headers: config.RealIPHeaders}
+	}
+
+	l, err := listenShared(u.Host, kindHTTP)
+	if err != nil {
+		return nil, err
+	}
+
+	hl := &h2Listener{Queue: transport.NewQueue(), srv: srv, l: l}
+	srv.Handler = func(c *h2.Conn, remoteAddr string) {
+		var conn net.Conn = c
+		if c.Mode() == transport.ModePacket {
+			conn = transport.NewPacketConn(c)
+		}
+		hl.Put(transport.Accepted(conn, c.User(), c.Mode(), remoteAddr))
+	}
+	go func() {
+		err := srv.Serve(l)
+		if err == http.ErrServerClosed {
+			err = transport.ErrClosed
+		}
+		hl.Stop(err)
+	}()
+	return hl, nil
+}
+
+func (l *h2Listener) Close() error {
+	l.Stop(transport.ErrClosed)
+	return l.l.Close()
+}
+
+func (l *h2Listener) Addr() net.Addr { return l.l.Addr() }
+
+// Shutdown stops the server gracefully, see h2.Server.Shutdown.
+func (l *h2Listener) Shutdown(ctx context.Context) error {
+	return l.srv.Shutdown(ctx)
+}
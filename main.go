@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
@@ -14,32 +16,67 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
 	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
 var config struct {
-	Verbose    bool
-	UDPTimeout time.Duration
+	Verbose       bool
+	UDPTimeout    time.Duration
+	TLSCert       string
+	TLSKey        string
+	TLSReload     time.Duration
+	TLSCA         string
+	TLSServerName string
+	TLSInsecure   bool
+	Mux           int
+	Pool          int
+	PoolIdle      time.Duration
+	PoolRefill    time.Duration
+	Fallback      bool
+	Decoy         string
+	WSDebug       bool
+	ZeroRTT       bool
+	EarlyData     int
+	Proxy         string
+	Host          string
+	UserAgent     string
+	Header        http.Header
+	Compress      bool
+	CompressLevel int
+	CompressSkip  map[string]bool
+	Grace         time.Duration
+	Keepalive     ws.Keepalive
+
+	TrustedProxies []*net.IPNet
+	RealIPHeaders  []string
+	ProxyProtocol  bool
 }
 
 func main() {
 
 	var flags struct {
-		Client     string
-		Server     string
-		Cipher     string
-		Key        string
-		Password   string
-		Keygen     int
-		Socks      string
-		RedirTCP   string
-		RedirTCP6  string
-		TCPTun     string
-		UDPTun     string
-		UDPSocks   bool
-		Plugin     string
-		PluginOpts string
+		Client       string
+		Server       listFlag
+		Cipher       string
+		Key          string
+		Password     string
+		Keygen       int
+		Socks        string
+		RedirTCP     string
+		RedirTCP6    string
+		TCPTun       string
+		UDPTun       string
+		UDPSocks     bool
+		Plugin       string
+		PluginOpts   string
+		AuthKeys     string
+		Users        string
+		CompressSkip string
+		Trusted      string
+		RealIP       string
 	}
 
 	flag.BoolVar(&config.Verbose, "verbose", false, "verbose mode")
@@ -47,7 +84,7 @@ func main() {
 	flag.StringVar(&flags.Key, "key", "", "base64url-encoded key (derive from password if empty)")
 	flag.IntVar(&flags.Keygen, "keygen", 0, "generate a base64url-encoded random key of given length in byte")
 	flag.StringVar(&flags.Password, "password", "", "password")
-	flag.StringVar(&flags.Server, "s", "", "server listen address or url")
+	flag.Var(&flags.Server, "s", "server listen address or url, repeatable to serve native ss:// and WebSocket side by side, even on one port")
 	flag.StringVar(&flags.Client, "c", "", "client connect address or url")
 	flag.StringVar(&flags.Socks, "socks", "", "(client-only) SOCKS listen address")
 	flag.BoolVar(&flags.UDPSocks, "u", false, "(client-only) Enable UDP support for SOCKS")
@@ -58,6 +95,38 @@ func main() {
 	flag.StringVar(&flags.Plugin, "plugin", "", "Enable SIP003 plugin. (e.g., v2ray-plugin)")
 	flag.StringVar(&flags.PluginOpts, "plugin-opts", "", "Set SIP003 plugin options. (e.g., \"server;tls;host=mydomain.me\")")
 	flag.DurationVar(&config.UDPTimeout, "udptimeout", 5*time.Minute, "UDP tunnel timeout")
+	flag.StringVar(&flags.AuthKeys, "authkeys", "", "(server-only) client keys accepted besides the one in the server URL (key1,key2,...)")
+	flag.StringVar(&flags.Users, "users", "", "(server-only) JSON file of users with their own keys and ciphers")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "(server-only) PEM certificate chain for wss://, https://, h2:// and quic:// servers")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "(server-only) PEM private key for wss://, https://, h2:// and quic:// servers")
+	flag.DurationVar(&config.TLSReload, "tls-reload", time.Minute, "(server-only) interval of checking the TLS certificate files for changes, 0 to only reload on SIGHUP")
+	flag.StringVar(&config.Decoy, "decoy", "", "(server-only) web site shown to non-WebSocket requests: a directory of static files or an http:// URL to reverse proxy")
+	flag.BoolVar(&config.WSDebug, "ws-debug", false, "(server-only) serve the diagnostic pages /hello, /ip and /headers")
+	flag.IntVar(&config.Mux, "mux", 0, "(client-only) multiplex TCP connections over this many WebSocket connections, 0 to use one per TCP connection")
+	flag.IntVar(&config.Pool, "pool", 0, "(client-only) keep this many WebSocket connections dialed in advance, unless multiplexing")
+	flag.DurationVar(&config.PoolIdle, "pool-idle", 30*time.Second, "(client-only) close pooled connections idle for longer than this")
+	flag.DurationVar(&config.PoolRefill, "pool-refill", 100*time.Millisecond, "(client-only) minimum delay between dials refilling the pool, doubled while dialing fails")
+	flag.BoolVar(&config.Fallback, "fallback", false, "(client-only) fall back to HTTP long polling for a while when WebSocket upgrades fail, e.g. behind proxies stripping them; the server must listen on an http:// or https:// URL")
+	flag.StringVar(&config.TLSCA, "tls-ca", "", "(client-only) PEM bundle of CAs trusted for wss://, https://, h2:// and quic:// servers instead of the system roots")
+	flag.StringVar(&config.TLSServerName, "tls-sni", "", "(client-only) server name sent in SNI and verified for wss://, https://, h2:// and quic:// servers")
+	flag.BoolVar(&config.TLSInsecure, "tls-insecure", false, "(client-only) do not verify the certificate of wss://, https://, h2:// and quic:// servers (testing only)")
+	flag.BoolVar(&config.ZeroRTT, "zero-rtt", false, "(client-only) send the target address with the WebSocket upgrade request, saving a round trip; needs a server of this version")
+	flag.IntVar(&config.EarlyData, "early-data", 0, "(client-only) with -zero-rtt, also send up to this many bytes of the first payload (at most 2048)")
+	flag.StringVar(&config.Proxy, "proxy", "", "(client-only) reach WebSocket and native servers, not QUIC ones, through this proxy: http://[user:pass@]host:port (CONNECT) or socks5://[user:pass@]host:port")
+	flag.StringVar(&config.Host, "ws-host", "", "(client-only) Host header of WebSocket upgrade requests instead of the host of the server URL")
+	flag.StringVar(&config.UserAgent, "user-agent", "", "(client-only) User-Agent header of WebSocket upgrade requests")
+	config.Header = http.Header{}
+	flag.Var(headerFlag(config.Header), "header", "(client-only) extra header \"Name: value\" of WebSocket upgrade requests, repeatable")
+	flag.BoolVar(&config.Compress, "compress", false, "compress the streams of WebSocket connections before encryption if both ends agree, except with -zero-rtt")
+	flag.IntVar(&config.CompressLevel, "compress-level", 1, "flate level of compressed streams, 1 (fastest) to 9 (best)")
+	flag.StringVar(&flags.CompressSkip, "compress-skip", "443,853,993,995", "do not compress traffic to targets on these ports (port1,port2,...)")
+	flag.DurationVar(&config.Grace, "grace", 10*time.Second, "(server-only) on SIGINT or SIGTERM, time given to open connections to end before closing them")
+	flag.DurationVar(&config.Keepalive.Interval, "ping", ws.DefaultKeepalive.Interval, "interval of WebSocket pings, 0 to send none")
+	flag.DurationVar(&config.Keepalive.Timeout, "ping-timeout", ws.DefaultKeepalive.Timeout, "close WebSocket connections not answering a ping within this time, 0 to not wait for answers")
+	flag.DurationVar(&config.Keepalive.Idle, "idle-timeout", ws.DefaultKeepalive.Idle, "close WebSocket connections idle for this long, 0 to keep them open")
+	flag.StringVar(&flags.Trusted, "trusted-proxies", "", "(server-only) CIDRs of reverse proxies and CDNs whose client address headers are believed (cidr1,cidr2,...)")
+	flag.StringVar(&flags.RealIP, "real-ip-headers", "", "(server-only) headers with the client IP set by trusted proxies, tried before X-Forwarded-For (e.g. CF-Connecting-IP,True-Client-IP)")
+	flag.BoolVar(&config.ProxyProtocol, "proxy-protocol", false, "(server-only) expect a PROXY protocol v1 or v2 header on connections from -trusted-proxies, or from everybody if empty")
 	flag.Parse()
 
 	if flags.Keygen > 0 {
@@ -67,7 +136,25 @@ func main() {
 		return
 	}
 
-	if flags.Client == "" && flags.Server == "" {
+	if config.CompressLevel < 1 || config.CompressLevel > 9 {
+		log.Fatal("-compress-level must be between 1 and 9")
+	}
+	config.CompressSkip = parsePorts(flags.CompressSkip)
+
+	if flags.Trusted != "" {
+		nets, err := ws.ParseCIDRs(flags.Trusted)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.TrustedProxies = nets
+	}
+	for _, h := range strings.Split(flags.RealIP, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			config.RealIPHeaders = append(config.RealIPHeaders, h)
+		}
+	}
+
+	if flags.Client == "" && len(flags.Server) == 0 {
 		flag.Usage()
 		return
 	}
@@ -96,6 +183,13 @@ func main() {
 
 		udpAddr := addr
 
+		if config.ZeroRTT && (config.Mux > 0 || config.Pool > 0) {
+			log.Fatal("-zero-rtt cannot be combined with -mux or -pool")
+		}
+		if config.EarlyData > 2048 {
+			log.Fatal("-early-data must be at most 2048")
+		}
+
 		ciph, err := core.PickCipher(cipher, key, password)
 		if err != nil {
 			log.Fatal(err)
@@ -139,26 +233,31 @@ func main() {
 		}
 	}
 
-	if flags.Server != "" { // server mode
-		addr := flags.Server
+	if len(flags.Server) > 0 { // server mode
 		cipher := flags.Cipher
 		password := flags.Password
 		var err error
 
-		if strings.HasPrefix(addr, "ss://") {
-			addr, cipher, password, err = parseURL(addr)
-			if err != nil {
-				log.Fatal(err)
+		var addrs, keys []string
+		var ssURL string
+		for _, addr := range flags.Server {
+			if strings.HasPrefix(addr, "ss://") {
+				var c, p string
+				addr, c, p, err = parseURL(addr)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if ssURL != "" && (c != cipher || p != password) {
+					log.Fatalf("%s and %s differ in cipher or password, use -users for more keys", ssURL, addr)
+				}
+				ssURL, cipher, password = addr, c, p
+			} else if u, err := url.Parse(strings.Trim(addr, "'")); err == nil && u.User.Username() != "" {
+				keys = append(keys, u.User.Username())
 			}
+			addrs = append(addrs, addr)
 		}
-
-		udpAddr := addr
-
-		if flags.Plugin != "" {
-			addr, err = startPlugin(flags.Plugin, flags.PluginOpts, addr, true)
-			if err != nil {
-				log.Fatal(err)
-			}
+		if flags.AuthKeys != "" {
+			keys = append(keys, strings.Split(flags.AuthKeys, ",")...)
 		}
 
 		ciph, err := core.PickCipher(cipher, key, password)
@@ -166,13 +265,39 @@ func main() {
 			log.Fatal(err)
 		}
 
-		go udpRemote(udpAddr, ciph.PacketConn)
-		go tcpRemote(addr, ciph.StreamConn)
+		users, err := loadUsers(flags.Users, ciph, cipher, keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		tcpAddrs := append([]string(nil), addrs...)
+		if flags.Plugin != "" { // SIP003 plugins front the first server
+			tcpAddrs[0], err = startPlugin(flags.Plugin, flags.PluginOpts, addrs[0], true)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, addr := range tcpAddrs { // before any server accepts on a shared port
+			expectServer(addr)
+		}
+		for i, addr := range addrs {
+			if !transport.Supported(addr) { // UDP arrives over the transport otherwise
+				go udpRemote(addr, users)
+			}
+			go tcpRemote(tcpAddrs[i], users)
+		}
 	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
+	go func() { // a second signal does not wait for the connections
+		<-sigCh
+		killPlugin()
+		os.Exit(1)
+	}()
+	logf("shutting down")
+	shutdown(config.Grace)
 	killPlugin()
 }
 
@@ -189,3 +314,13 @@ func parseURL(s string) (addr, cipher, password string, err error) {
 	}
 	return
 }
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
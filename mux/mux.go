@@ -0,0 +1,256 @@
+// Package mux multiplexes many streams over one reliable connection.
+//
+// Each frame starts with a 7-byte header: 1-byte command, 4-byte big-endian
+// stream ID and 2-byte big-endian payload length. Streams opened by the
+// client have odd IDs and those opened by the server even ones.
+//
+// Every stream is flow controlled on its own: a sender may have at most
+// window bytes in flight until the receiver reports them read with a
+// window update, so a stream whose reader stalls does not hold up the
+// others. A stream closes each direction independently with FIN and aborts
+// with RST.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	cmdSYN byte = iota // open a stream
+	cmdPSH             // stream data
+	cmdFIN             // sender will not write any more
+	cmdRST             // abort the stream in both directions
+	cmdWND             // 4-byte window increment
+)
+
+const (
+	headerSize = 7
+
+	// maxPayload is the maximum payload of a data frame.
+	maxPayload = 16 * 1024
+
+	// window is the number of bytes a stream accepts before its reader
+	// catches up.
+	window = 256 * 1024
+
+	// acceptBacklog is the number of opened streams waiting for Accept.
+	acceptBacklog = 1024
+)
+
+var (
+	// ErrClosed is returned when using a closed stream or session.
+	ErrClosed = errors.New("mux: use of closed stream or session")
+
+	// ErrReset is returned when writing to a stream the peer aborted.
+	ErrReset = errors.New("mux: stream reset by peer")
+
+	errProtocol = errors.New("mux: protocol error")
+)
+
+// Session multiplexes streams over a connection.
+type Session struct {
+	conn   net.Conn
+	nextID uint32 // next ID of a stream opened by this side
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	accepts chan *Stream
+
+	wmu  sync.Mutex // serializes frames written to conn
+	wbuf []byte
+
+	die     chan struct{}
+	dieOnce sync.Once
+	dieErr  error
+}
+
+// Client returns the session of the side that dialed conn.
+func Client(conn net.Conn) *Session { return newSession(conn, 1) }
+
+// Server returns the session of the side that accepted conn.
+func Server(conn net.Conn) *Session { return newSession(conn, 2) }
+
+func newSession(conn net.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:    conn,
+		nextID:  firstID,
+		streams: make(map[uint32]*Stream),
+		accepts: make(chan *Stream, acceptBacklog),
+		wbuf:    make([]byte, headerSize+maxPayload),
+		die:     make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open opens a new stream to the peer.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, s.dieErr
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.die:
+		return nil, s.dieErr
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed reports whether the session is closed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the connection and with it every stream.
+func (s *Session) Close() error {
+	s.closeWithError(ErrClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.dieOnce.Do(func() {
+		s.mu.Lock()
+		s.dieErr = err
+		close(s.die)
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		s.conn.Close()
+		for _, st := range streams {
+			st.abort(err)
+		}
+	})
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.IsClosed() {
+		return s.dieErr
+	}
+
+	b := s.wbuf[:headerSize+len(payload)]
+	b[0] = cmd
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint16(b[5:], uint16(len(payload)))
+	copy(b[headerSize:], payload)
+
+	if _, err := s.conn.Write(b); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	hdr := make([]byte, headerSize)
+	buf := make([]byte, 1<<16)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		cmd, id := hdr[0], binary.BigEndian.Uint32(hdr[1:])
+		payload := buf[:binary.BigEndian.Uint16(hdr[5:])]
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		if err := s.handleFrame(cmd, id, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(cmd byte, id uint32, payload []byte) error {
+	if cmd == cmdSYN {
+		s.mu.Lock()
+		if _, ok := s.streams[id]; ok || id%2 == s.nextID%2 {
+			s.mu.Unlock()
+			return errProtocol
+		}
+		st := newStream(id, s)
+		s.streams[id] = st
+		s.mu.Unlock()
+
+		select {
+		case s.accepts <- st:
+			return nil
+		default: // backlog full, refuse
+			s.remove(id)
+			return s.writeFrame(cmdRST, id, nil)
+		}
+	}
+
+	st := s.stream(id)
+	if st == nil { // closed locally, drop what the peer sent meanwhile
+		return nil
+	}
+
+	switch cmd {
+	case cmdPSH:
+		return st.push(payload)
+	case cmdFIN:
+		st.remoteFIN()
+	case cmdRST:
+		s.remove(id)
+		st.remoteRST()
+	case cmdWND:
+		if len(payload) != 4 {
+			return errProtocol
+		}
+		st.grow(int(binary.BigEndian.Uint32(payload)))
+	default:
+		return errProtocol
+	}
+	return nil
+}
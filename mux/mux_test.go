@@ -0,0 +1,156 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair returns the client and server sessions of a loopback TCP connection.
+func pair(t *testing.T) (client, server *Session) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server = Client(c), Server(<-ch)
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return
+}
+
+func echo(sess *Session) {
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(st, st)
+			st.CloseWrite()
+		}()
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	client, server := pair(t)
+	go echo(server)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+
+			msg := make([]byte, 3*window+123) // more than a window each way
+			rand.Read(msg)
+			go func() {
+				st.Write(msg)
+				st.CloseWrite()
+			}()
+			got, err := io.ReadAll(st)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("got %d bytes, want %d", len(got), len(msg))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStalledStreamDoesNotBlockOthers(t *testing.T) {
+	client, server := pair(t)
+
+	stalled, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil { // never read from
+		t.Fatal(err)
+	}
+	stalled.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := stalled.Write(make([]byte, 2*window))
+	if err, ok := err.(net.Error); !ok || !err.Timeout() || n != window {
+		t.Fatalf("wrote %d bytes past the window: %v", n, err)
+	}
+
+	go echo(server)
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(st, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestHalfCloseAndReset(t *testing.T) {
+	client, server := pair(t)
+
+	a, _ := client.Open()
+	b, _ := client.Open()
+	sa, _ := server.Accept()
+	sb, _ := server.Accept()
+
+	// a: request, half-close, then response
+	a.Write([]byte("request"))
+	a.CloseWrite()
+	req, err := io.ReadAll(sa)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("read %q, %v", req, err)
+	}
+	sa.Write([]byte("response"))
+	sa.Close()
+	resp, err := io.ReadAll(a)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("read %q, %v", resp, err)
+	}
+
+	// b: closing without reading from the peer resets the stream
+	b.Close()
+	sb.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := sb.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	for { // the RST may take a moment to arrive
+		if _, err := sb.Write([]byte("x")); err == ErrReset {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := client.NumStreams(); n != 1 { // a is still open on this side
+		t.Fatalf("%d streams open", n)
+	}
+}
@@ -0,0 +1,278 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a flow-controlled stream within a Session. It implements net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	wmu sync.Mutex // serializes writers
+
+	mu        sync.Mutex
+	buf       bytes.Buffer // received data not read yet
+	unacked   int          // bytes read but not reported in a window update
+	window    int          // bytes the peer accepts before the next window update
+	recvEOF   bool         // peer sent FIN or RST
+	reset     bool         // peer sent RST
+	finSent   bool
+	closed    bool
+	err       error // set when the session dies
+	rdeadline time.Time
+	wdeadline time.Time
+
+	readable chan struct{} // signaled when Read may make progress
+	writable chan struct{} // signaled when Write may make progress
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:       id,
+		sess:     sess,
+		window:   window,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is signaled or deadline passes.
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Read reads data sent by the peer. It returns io.EOF after the peer closed
+// its writing side and all data has been read.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, ErrClosed
+		}
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.unacked += n
+			var update int
+			if st.unacked >= window/2 && !st.recvEOF {
+				update, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				var p [4]byte
+				binary.BigEndian.PutUint32(p[:], uint32(update))
+				st.sess.writeFrame(cmdWND, st.id, p[:])
+			}
+			return n, nil
+		}
+		if st.recvEOF {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.err != nil {
+			st.mu.Unlock()
+			return 0, st.err
+		}
+		deadline := st.rdeadline
+		st.mu.Unlock()
+
+		if err := wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b to the peer, waiting for window updates when the peer has
+// not read enough yet. The write deadline bounds that waiting.
+func (st *Stream) Write(b []byte) (n int, err error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	for len(b) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed:
+			err = ErrClosed
+		case st.finSent:
+			err = io.ErrClosedPipe
+		case st.reset:
+			err = ErrReset
+		case st.err != nil:
+			err = st.err
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return
+		}
+		if st.window == 0 {
+			deadline := st.wdeadline
+			st.mu.Unlock()
+			if err = wait(st.writable, deadline); err != nil {
+				return
+			}
+			continue
+		}
+		k := len(b)
+		if k > st.window {
+			k = st.window
+		}
+		if k > maxPayload {
+			k = maxPayload
+		}
+		st.window -= k
+		st.mu.Unlock()
+
+		if err = st.sess.writeFrame(cmdPSH, st.id, b[:k]); err != nil {
+			return
+		}
+		n += k
+		b = b[k:]
+	}
+	return
+}
+
+// CloseWrite tells the peer that no more data will be written, while data
+// from the peer can still be read.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.finSent || st.reset || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mu.Unlock()
+	notify(st.writable)
+
+	return st.sess.writeFrame(cmdFIN, st.id, nil)
+}
+
+// Close closes the stream. It finishes the stream gracefully if the peer
+// has closed its side already and aborts it with a reset otherwise.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	graceful, finSent := st.recvEOF, st.finSent
+	done := st.reset || st.err != nil
+	st.finSent = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+
+	st.sess.remove(st.id)
+	switch {
+	case done:
+		return nil
+	case !graceful:
+		return st.sess.writeFrame(cmdRST, st.id, nil)
+	case !finSent:
+		return st.sess.writeFrame(cmdFIN, st.id, nil)
+	}
+	return nil
+}
+
+// push queues data received from the peer.
+func (st *Stream) push(p []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.recvEOF {
+		return errProtocol
+	}
+	if st.buf.Len()+st.unacked+len(p) > window {
+		return errProtocol // peer ignored the window
+	}
+	if !st.closed {
+		st.buf.Write(p)
+	}
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) remoteFIN() {
+	st.mu.Lock()
+	st.recvEOF = true
+	st.mu.Unlock()
+	notify(st.readable)
+}
+
+func (st *Stream) remoteRST() {
+	st.mu.Lock()
+	st.recvEOF = true
+	st.reset = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *Stream) grow(n int) {
+	st.mu.Lock()
+	st.window += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+// abort fails pending and future operations with err after the session died.
+func (st *Stream) abort(err error) {
+	st.mu.Lock()
+	st.err = err
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rdeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wdeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+// Time allowed to a native client to send enough to tell its user.
+const identifyTimeout = 10 * time.Second
+
+// newDialer returns the dialer of server: a transport for URLs and the
+// native Shadowsocks protocol for plain addresses.
+func newDialer(server string) (transport.Dialer, error) {
+	if transport.Supported(server) {
+		return transport.NewDialer(server)
+	}
+	proxy, err := clientProxy()
+	if err != nil {
+		return nil, err
+	}
+	return &ssDialer{addr: server, proxy: proxy}, nil
+}
+
+// ssDialer connects to a native Shadowsocks server at its address, through
+// the upstream proxy if any.
+type ssDialer struct {
+	addr  string
+	proxy *url.URL
+}
+
+// Dial connects to the server. Native servers carry a single stream per
+// connection, so only transport.ModeStream is supported.
+func (d *ssDialer) Dial(mode string) (net.Conn, error) {
+	if mode != transport.ModeStream {
+		return nil, fmt.Errorf("native Shadowsocks server %s does not support %s", d.addr, mode)
+	}
+	if d.proxy != nil {
+		return ws.DialProxy(d.proxy, d.addr)
+	}
+	c, err := net.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.(*net.TCPConn).SetKeepAlive(true)
+	return c, nil
+}
+
+// ssListener accepts native Shadowsocks connections. Without credentials
+// in the protocol, the user of a connection is the one whose key decrypts
+// its first chunk.
+type ssListener struct {
+	net.Listener
+	users *userTable
+	conns chan net.Conn
+
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+// ssConn is a native Shadowsocks connection of an identified user.
+type ssConn struct {
+	net.Conn
+	r    io.Reader // replays the bytes read to identify the user
+	user string
+}
+
+func (c *ssConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *ssConn) CloseWrite() error          { return closeWrite(c.Conn) }
+func (c *ssConn) User() string               { return c.user }
+
+func listenSS(addr string, users *userTable) (transport.Listener, error) {
+	l, err := listenShared(addr, kindSS)
+	if err != nil {
+		return nil, err
+	}
+	sl := &ssListener{Listener: l, users: users, conns: make(chan net.Conn), done: make(chan struct{})}
+	go sl.serve()
+	return sl, nil
+}
+
+func (l *ssListener) serve() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			l.close(err)
+			return
+		}
+		go l.identify(c)
+	}
+}
+
+// identify hands c over to Accept once its user is known.
+func (l *ssListener) identify(c net.Conn) {
+	br := bufio.NewReader(c)
+	usr := l.users.identify(nil) // plaintext users need not wait for data
+	if usr == nil {
+		c.SetReadDeadline(time.Now().Add(identifyTimeout))
+		hdr, err := br.Peek(identifyHeader)
+		c.SetReadDeadline(time.Time{})
+		if err != nil && len(hdr) == 0 {
+			logf("failed to read from %s: %v", c.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+		usr = l.users.identify(hdr)
+	}
+	if usr == nil {
+		logf("no user can decrypt the stream from %s", c.RemoteAddr())
+		c.Close()
+		return
+	}
+
+	select {
+	case l.conns <- &ssConn{Conn: c, r: br, user: usr.Name}:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *ssListener) close(err error) {
+	l.doneOnce.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *ssListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *ssListener) Close() error {
+	l.close(transport.ErrClosed)
+	return l.Listener.Close()
+}
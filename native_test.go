@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// testUsers returns a table of the default user with AES-128-GCM, alice with
+// AES-256-GCM and bob with ChaCha20-Poly1305.
+func testUsers(t *testing.T) *userTable {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.json")
+	users := `[
+		{"name": "alice", "key": "ak", "cipher": "AEAD_AES_256_GCM", "password": "apass"},
+		{"name": "bob", "key": "bk", "cipher": "AEAD_CHACHA20_POLY1305", "password": "bpass"}
+	]`
+	if err := os.WriteFile(path, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ciph := pickCipher(t, "AEAD_AES_128_GCM", "pass")
+	table, err := loadUsers(path, ciph, "AEAD_AES_128_GCM", []string{"dk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func pickCipher(t *testing.T, cipher, password string) core.Cipher {
+	t.Helper()
+	ciph, err := core.PickCipher(cipher, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciph
+}
+
+// seal returns the stream of a client of ciph sending payload. Unlike a
+// client in this process, it leaves the salt out of the replay check.
+func seal(t *testing.T, ciph core.Cipher, payload []byte) []byte {
+	t.Helper()
+	sc := ciph.(shadowaead.Cipher)
+	salt := make([]byte, sc.SaltSize())
+	rand.Read(salt)
+	aead, err := sc.Encrypter(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(salt)
+	shadowaead.NewWriter(buf, aead).Write(payload)
+	return buf.Bytes()
+}
+
+func TestIdentify(t *testing.T) {
+	users := testUsers(t)
+	payload := []byte("GET / HTTP/1.1\r\n\r\n")
+
+	for _, tc := range []struct {
+		name string
+		ciph core.Cipher
+		want *user
+	}{
+		{"default", pickCipher(t, "AEAD_AES_128_GCM", "pass"), users.byName[""]},
+		{"alice", pickCipher(t, "AEAD_AES_256_GCM", "apass"), users.byName["alice"]},
+		{"bob", pickCipher(t, "AEAD_CHACHA20_POLY1305", "bpass"), users.byName["bob"]},
+		{"wrong password", pickCipher(t, "AEAD_AES_256_GCM", "nope"), nil},
+		{"wrong cipher", pickCipher(t, "AEAD_CHACHA20_POLY1305", "apass"), nil},
+	} {
+		hdr := seal(t, tc.ciph, payload)
+		if len(hdr) > identifyHeader {
+			hdr = hdr[:identifyHeader]
+		}
+		if got := users.identify(hdr); got != tc.want {
+			t.Errorf("%s: identified %v, want %v", tc.name, got, tc.want)
+		}
+		if got := users.identify(hdr[:20]); got != nil {
+			t.Errorf("%s: identified %v from a short header", tc.name, got)
+		}
+	}
+}
+
+func TestSSListener(t *testing.T) {
+	users := testUsers(t)
+	l, err := listenSS("127.0.0.1:0", users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	send := func(b []byte) net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.Write(b)
+		return c
+	}
+	accept := func() net.Conn {
+		t.Helper()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				accepted <- c
+			}
+		}()
+		select {
+		case c := <-accepted:
+			t.Cleanup(func() { c.Close() })
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("no connection accepted")
+			return nil
+		}
+	}
+
+	payload := bytes.Repeat([]byte("bob's data "), 10)
+	stream := seal(t, pickCipher(t, "AEAD_CHACHA20_POLY1305", "bpass"), payload)
+	send(stream)
+	c := accept()
+	if u := transport.User(c); u != "bob" {
+		t.Fatalf("accepted user %q, want bob", u)
+	}
+	b := make([]byte, len(payload))
+	if _, err := io.ReadFull(users.byName["bob"].ciph.StreamConn(c), b); err != nil || !bytes.Equal(b, payload) {
+		t.Fatalf("read %q, %v", b, err)
+	}
+
+	// a wrong key is refused before Accept
+	wrong := send(seal(t, pickCipher(t, "AEAD_AES_256_GCM", "nope"), payload))
+	wrong.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := wrong.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection with a wrong key got %v, want EOF", err)
+	}
+
+	// a replayed stream identifies its user again but fails the salt check
+	send(stream)
+	c = accept()
+	_, err = users.byName["bob"].ciph.StreamConn(c).Read(b)
+	if err != shadowaead.ErrRepeatedSalt {
+		t.Fatalf("replayed stream read %v, want %v", err, shadowaead.ErrRepeatedSalt)
+	}
+}
+
+func TestQUICProxy(t *testing.T) {
+	defer func() { config.Proxy = "" }()
+	for _, proxy := range []string{"", "socks5://127.0.0.1:1080"} {
+		config.Proxy = proxy
+		_, err := newDialer("quic://k@127.0.0.1:443")
+		if (err != nil) != (proxy != "") {
+			t.Errorf("-proxy %q: %v", proxy, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package poll
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Attempts of a request before the session is given up.
+const attempts = 3
+
+// A Dialer opens sessions with a server.
+type Dialer struct {
+	// TLSConfig, Proxy and Header are as in ws.Dialer, TLSConfig being
+	// used for https:// URLs and Header sent with every request.
+	TLSConfig *tls.Config
+	Proxy     *url.URL
+	Header    http.Header
+
+	once   sync.Once
+	client *http.Client
+}
+
+func (d *Dialer) init() {
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     d.TLSConfig,
+		MaxIdleConnsPerHost: 64,
+	}
+	if d.Proxy != nil {
+		t.Proxy = http.ProxyURL(d.Proxy)
+	}
+	d.client = &http.Client{Transport: t, Timeout: pollTimeout + 30*time.Second}
+}
+
+// clientSession sends the requests of a Conn.
+type clientSession struct {
+	d      *Dialer
+	url    string
+	header http.Header
+	conn   *Conn
+	ctx    context.Context // of polls, canceled once conn is closed
+}
+
+// Dial opens a session in mode with the server at urlStr (http:// or
+// https://) and sends h with its requests.
+func (d *Dialer) Dial(urlStr, mode string, h http.Header) (*Conn, error) {
+	d.once.Do(d.init)
+
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	for k, v := range d.Header {
+		header[k] = v
+	}
+	for k, v := range h {
+		header[k] = v
+	}
+	header.Set(SessionHeader, id)
+	if mode != "" {
+		header.Set(ModeHeader, mode)
+	}
+
+	conn := newConn()
+	conn.mode = mode
+	conn.raddr = addr(u.Host)
+	conn.laddr = addr("")
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &clientSession{d: d, url: urlStr, header: header, conn: conn, ctx: ctx}
+
+	resp, err := s.do(ctx, http.MethodPost, 0, nil, false)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.Header.Get(ModeHeader) != mode {
+		cancel()
+		return nil, fmt.Errorf("poll: server does not support mode %q", mode)
+	}
+
+	go func() {
+		<-conn.done
+		cancel()
+	}()
+	go s.upload()
+	go s.poll()
+	return conn, nil
+}
+
+// do sends a request with the body p at offset off, trying again when it
+// fails on the way.
+func (s *clientSession) do(ctx context.Context, method string, off int64, p []byte, fin bool) (*http.Response, error) {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(time.Duration(i) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		var req *http.Request
+		req, err = s.newRequest(ctx, method, off, p, fin)
+		if err != nil {
+			return nil, err
+		}
+		var resp *http.Response
+		resp, err = s.d.client.Do(req)
+		if err != nil {
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		case resp.StatusCode >= 500: // try again
+			err = fmt.Errorf("poll: bad status %s", resp.Status)
+			resp.Body.Close()
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("poll: bad status %s", resp.Status)
+		}
+	}
+	return nil, err
+}
+
+func (s *clientSession) newRequest(ctx context.Context, method string, off int64, p []byte, fin bool) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url, bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	req.Header.Set(OffsetHeader, strconv.FormatInt(off, 10))
+	if fin {
+		req.Header.Set(FinHeader, "1")
+	}
+	return req, nil
+}
+
+// upload sends the bytes written to the connection, batching those written
+// while a request is in progress. The bytes written before CloseWrite or
+// Close are still sent, and the session ends with Close.
+func (s *clientSession) upload() {
+	q := s.conn.out
+	for {
+		q.mu.Lock()
+		for len(q.buf) == 0 && !q.eof {
+			q.wait(time.Time{}, nil)
+		}
+		off := q.base
+		n := len(q.buf)
+		if n > maxBatch {
+			n = maxBatch
+		}
+		p := append([]byte(nil), q.buf[:n]...)
+		fin := q.eof && n == len(q.buf)
+		q.mu.Unlock()
+
+		resp, err := s.do(context.Background(), http.MethodPost, off, p, fin)
+		if err != nil {
+			s.conn.in.fail(err)
+			s.conn.Close()
+			return
+		}
+		resp.Body.Close()
+		q.remove(off + int64(n))
+
+		if fin {
+			<-s.conn.done // after CloseWrite, the server may still be sending
+			s.end()
+			return
+		}
+	}
+}
+
+// end tells the server the session is over.
+func (s *clientSession) end() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := s.newRequest(ctx, http.MethodDelete, 0, nil, false)
+	if err != nil {
+		return
+	}
+	if resp, err := s.d.client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// poll receives the bytes of the server until it is done writing.
+func (s *clientSession) poll() {
+	q := s.conn.in
+	var off int64 // of the next byte to receive
+	for {
+		q.mu.Lock()
+		for len(q.buf) >= maxQueued && q.wait(time.Time{}, s.conn.done) {
+		}
+		q.mu.Unlock()
+
+		resp, err := s.do(s.ctx, http.MethodGet, off, nil, false)
+		if err != nil {
+			q.fail(err)
+			return
+		}
+		p, err := io.ReadAll(io.LimitReader(resp.Body, maxBatch+1))
+		resp.Body.Close()
+		if err != nil { // ask for the same bytes again
+			continue
+		}
+		fin := resp.Header.Get(FinHeader) != ""
+		if !q.add(off, p, fin) {
+			q.fail(errOffset)
+			return
+		}
+		off += int64(len(p))
+		if fin {
+			return
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package poll
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Most bytes queued in either direction before writers wait, or the
+// server stops accepting uploads, until the other end catches up.
+const maxQueued = 1 << 20
+
+// Conn is a net.Conn carrying a byte stream over HTTP requests of a
+// session. Writes are queued until a request sends them.
+type Conn struct {
+	in   *queue // bytes to Read
+	out  *queue // bytes written
+	user string
+	mode string
+
+	laddr, raddr net.Addr
+
+	dmu      sync.Mutex
+	rdl, wdl time.Time // read and write deadlines
+
+	closeOnce sync.Once
+	onClose   func()        // called once closed, if not nil
+	done      chan struct{} // closed by Close
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func newConn() *Conn {
+	return &Conn{in: newQueue(), out: newQueue(), done: make(chan struct{})}
+}
+
+// Read reads the bytes received from the peer.
+func (c *Conn) Read(p []byte) (int, error) {
+	q := c.in
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.buf) == 0 {
+		select {
+		case <-c.done:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+		if q.err != nil {
+			return 0, q.err
+		}
+		if q.eof {
+			return 0, io.EOF
+		}
+		c.dmu.Lock()
+		dl := c.rdl
+		c.dmu.Unlock()
+		if !dl.IsZero() && !time.Now().Before(dl) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		q.wait(dl, c.done)
+	}
+	n := copy(p, q.buf)
+	q.buf = q.buf[n:]
+	if len(q.buf) == 0 {
+		q.buf = nil
+	}
+	q.base += int64(n)
+	q.notify()
+	return n, nil
+}
+
+// Write queues p for the peer, waiting while too much is queued already.
+func (c *Conn) Write(p []byte) (int, error) {
+	q := c.out
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.buf) >= maxQueued {
+		select {
+		case <-c.done:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+		c.dmu.Lock()
+		dl := c.wdl
+		c.dmu.Unlock()
+		if !dl.IsZero() && !time.Now().Before(dl) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		q.wait(dl, c.done)
+	}
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	if q.eof {
+		return 0, io.ErrClosedPipe
+	}
+	q.buf = append(q.buf, p...)
+	q.notify()
+	return len(p), nil
+}
+
+// CloseWrite ends the stream of the local side. The peer reads io.EOF once
+// it has read the bytes written before.
+func (c *Conn) CloseWrite() error {
+	c.out.close()
+	return nil
+}
+
+// Close ends the stream in both directions.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.out.close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+// User returns the user the server authorized the session for.
+func (c *Conn) User() string { return c.user }
+
+// Mode returns the mode the client asked for in ModeHeader.
+func (c *Conn) Mode() string { return c.mode }
+
+func (c *Conn) LocalAddr() net.Addr  { return c.laddr }
+func (c *Conn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.dmu.Lock()
+	c.rdl, c.wdl = t, t
+	c.dmu.Unlock()
+	c.wake()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.dmu.Lock()
+	c.rdl = t
+	c.dmu.Unlock()
+	c.wake()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.dmu.Lock()
+	c.wdl = t
+	c.dmu.Unlock()
+	c.wake()
+	return nil
+}
+
+// wake makes blocked reads and writes check their deadlines again.
+func (c *Conn) wake() {
+	for _, q := range []*queue{c.in, c.out} {
+		q.mu.Lock()
+		q.notify()
+		q.mu.Unlock()
+	}
+}
+
+// addr is the address of a session, which is not a network connection of
+// its own.
+type addr string
+
+func (a addr) Network() string { return "poll" }
+func (a addr) String() string  { return string(a) }
@@ -0,0 +1,63 @@
+// Package poll carries byte streams over ordinary HTTP requests for
+// networks that do not let WebSocket upgrades through. A stream is a
+// session of requests sharing an ID: GET requests poll for the bytes of the
+// server and POST requests upload those of the client.
+//
+// Both directions number their bytes by offset. A GET request acknowledges
+// the bytes of the server before its offset and waits for the following
+// ones; a POST request uploads bytes starting at its offset. Requests that
+// fail are repeated with the same offset, so no bytes are lost or
+// duplicated. The client ends a session with a DELETE request.
+package poll
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Headers of the requests and responses of sessions.
+const (
+	// SessionHeader carries the ID of the session of a request.
+	SessionHeader = "X-Session"
+
+	// OffsetHeader carries the offset of the first byte uploaded by a
+	// POST request, or expected by a GET request.
+	OffsetHeader = "X-Offset"
+
+	// FinHeader marks the last bytes of a direction of the stream.
+	FinHeader = "X-Fin"
+
+	// ModeHeader carries the mode of a session, which the server echoes
+	// in the response if it accepts it.
+	ModeHeader = "X-Mode"
+)
+
+// Most bytes in a request or response body.
+const maxBatch = 256 << 10
+
+// Timeouts of requests and sessions, variables for tests.
+var (
+	// Time a GET request waits for bytes of the server before returning
+	// empty, short enough for proxies not to time out. Uploads wait as
+	// long for room in a full queue.
+	pollTimeout = 20 * time.Second
+
+	// Time without requests after which the server drops a session.
+	sessionTimeout = time.Minute
+)
+
+var (
+	errSession = errors.New("poll: session lost")
+	errOffset  = errors.New("poll: bytes went missing")
+)
+
+// newSessionID returns a random session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,228 @@
+package poll
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serve starts s on a loopback HTTP server and returns its URL with the
+// connections of the sessions s opens.
+func serve(t *testing.T, s *Server) (string, <-chan *Conn) {
+	conns := make(chan *Conn, 4)
+	s.Handler = func(c *Conn, _ string) {
+		t.Cleanup(func() { c.Close() })
+		conns <- c
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts.URL + s.Path, conns
+}
+
+// request sends a request of the session id at offset off and returns the
+// status and the body of the response.
+func request(t *testing.T, url, method, id string, off int64, body []byte) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(SessionHeader, id)
+	req.Header.Set(OffsetHeader, strconv.FormatInt(off, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// setTimeouts shortens the timeouts of polls and sessions for a test.
+func setTimeouts(t *testing.T, poll, session time.Duration) {
+	oldPoll, oldSession := pollTimeout, sessionTimeout
+	pollTimeout, sessionTimeout = poll, session
+	t.Cleanup(func() { pollTimeout, sessionTimeout = oldPoll, oldSession })
+}
+
+func TestOffsets(t *testing.T) {
+	url, conns := serve(t, &Server{})
+	const id = "session"
+	if code, _ := request(t, url, "POST", id, 0, []byte("hello")); code != http.StatusOK {
+		t.Fatalf("opening POST: %d", code)
+	}
+	c := <-conns
+
+	// uploads beyond the end lost bytes, repeated ones overlap
+	if code, _ := request(t, url, "POST", id, 10, []byte("x")); code != http.StatusConflict {
+		t.Fatalf("POST beyond the end: %d, want 409", code)
+	}
+	if code, _ := request(t, url, "POST", id, 3, []byte("lo world")); code != http.StatusOK {
+		t.Fatalf("overlapping POST: %d", code)
+	}
+	b := make([]byte, 11)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello world" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+
+	// polls get the bytes from their offset on until acknowledged
+	c.Write([]byte("abcdef"))
+	for _, tc := range []struct {
+		off  int64
+		code int
+		body string
+	}{
+		{0, http.StatusOK, "abcdef"},
+		{0, http.StatusOK, "abcdef"}, // the response got lost
+		{3, http.StatusOK, "def"},
+		{1, http.StatusConflict, ""}, // acknowledged already
+		{7, http.StatusConflict, ""}, // beyond the end
+	} {
+		code, body := request(t, url, "GET", id, tc.off, nil)
+		if code != tc.code || (code == http.StatusOK && body != tc.body) {
+			t.Fatalf("GET at %d: %d %q, want %d %q", tc.off, code, body, tc.code, tc.body)
+		}
+	}
+
+	if code, _ := request(t, url, "POST", "other", 5, []byte("x")); code != http.StatusNotFound {
+		t.Fatalf("POST to an unknown session: %d, want 404", code)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	setTimeouts(t, pollTimeout, 100*time.Millisecond)
+	url, conns := serve(t, &Server{})
+	const id = "session"
+	request(t, url, "POST", id, 0, []byte("hi"))
+	c := <-conns
+
+	b := make([]byte, 2)
+	io.ReadFull(c, b)
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("read from an expired session")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session not expired")
+	}
+	if code, _ := request(t, url, "POST", id, 2, []byte("x")); code != http.StatusNotFound {
+		t.Fatalf("POST to an expired session: %d, want 404", code)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	setTimeouts(t, 100*time.Millisecond, sessionTimeout)
+	url, conns := serve(t, &Server{})
+	const id = "session"
+	batch := make([]byte, maxBatch)
+
+	// the server refuses uploads while maxQueued bytes wait for Read
+	var off int64
+	for ; off < maxQueued; off += maxBatch {
+		if code, _ := request(t, url, "POST", id, off, batch); code != http.StatusOK {
+			t.Fatalf("POST at %d: %d", off, code)
+		}
+	}
+	c := <-conns
+	if code, _ := request(t, url, "POST", id, off, batch); code != http.StatusServiceUnavailable {
+		t.Fatalf("POST to a full queue: %d, want 503", code)
+	}
+	if _, err := io.ReadFull(c, batch); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := request(t, url, "POST", id, off, batch); code != http.StatusOK {
+		t.Fatalf("POST once read: %d", code)
+	}
+
+	// writers wait while maxQueued bytes were not polled
+	c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := c.Write(make([]byte, maxQueued)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("x")); err != os.ErrDeadlineExceeded {
+		t.Fatalf("write to a full queue: %v", err)
+	}
+	if code, _ := request(t, url, "GET", id, 0, nil); code != http.StatusOK {
+		t.Fatalf("GET: %d", code)
+	}
+	c.SetWriteDeadline(time.Time{})
+	// acknowledging the first batch makes room
+	if code, _ := request(t, url, "GET", id, maxBatch, nil); code != http.StatusOK {
+		t.Fatalf("GET: %d", code)
+	}
+	if _, err := c.Write([]byte("x")); err != nil {
+		t.Fatalf("write after the poll: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	url, conns := serve(t, &Server{})
+	c, err := (&Dialer{}).Dial(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := <-conns
+	sc.Write([]byte("bye"))
+	sc.Close()
+
+	// the bytes written before Close arrive, then EOF
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "bye" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	c.Close()
+	if _, err := sc.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from closed conn")
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	url, conns := serve(t, &Server{})
+	c, err := (&Dialer{}).Dial(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("last words"))
+	c.Close()
+	if b, _ := io.ReadAll(<-conns); string(b) != "last words" {
+		t.Fatalf("server read %q", b)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	url, conns := serve(t, &Server{})
+	c, err := (&Dialer{}).Dial(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := <-conns
+
+	c.Write([]byte("upload"))
+	c.CloseWrite()
+	if _, err := c.Write([]byte("more")); err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+	// the server replies once it read EOF
+	b, _ := io.ReadAll(sc)
+	sc.Write(append([]byte("got "), b...))
+	sc.Close()
+	b, err = io.ReadAll(c)
+	if err != nil || string(b) != "got upload" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
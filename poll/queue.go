@@ -0,0 +1,107 @@
+package poll
+
+import (
+	"sync"
+	"time"
+)
+
+// queue is a byte queue of one direction of a stream. Bytes are numbered
+// by their offset in the stream, and stay queued until removed up to an
+// offset, so that they can be sent again when a request fails.
+type queue struct {
+	mu      sync.Mutex
+	buf     []byte        // bytes from offset base on
+	base    int64         // offset of buf[0]
+	eof     bool          // no more bytes will be added
+	err     error         // why the stream failed, if it did
+	changed chan struct{} // closed and replaced on every change
+}
+
+func newQueue() *queue {
+	return &queue{changed: make(chan struct{})}
+}
+
+// notify wakes up the waiters. It is called with q.mu held.
+func (q *queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// wait waits for a change of q, for the time t or for done, whichever comes
+// first. It is called with q.mu held, which it releases while waiting. It
+// reports false if t passed or done is closed.
+func (q *queue) wait(t time.Time, done <-chan struct{}) bool {
+	changed := q.changed
+	q.mu.Unlock()
+	defer q.mu.Lock()
+
+	var timeout <-chan time.Time
+	if !t.IsZero() {
+		timer := time.NewTimer(time.Until(t))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+		return true
+	case <-timeout:
+		return false
+	case <-done:
+		return false
+	}
+}
+
+// end returns the offset following the last byte queued. It is called with
+// q.mu held.
+func (q *queue) end() int64 { return q.base + int64(len(q.buf)) }
+
+// add appends p at offset off, skipping the part of p that is queued
+// already. It reports false if off is beyond the end of q, which means
+// bytes went missing.
+func (q *queue) add(off int64, p []byte, eof bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	end := q.end()
+	if off > end {
+		return false
+	}
+	if skip := end - off; skip < int64(len(p)) {
+		q.buf = append(q.buf, p[skip:]...)
+	}
+	q.eof = q.eof || eof
+	q.notify()
+	return true
+}
+
+// remove drops the bytes before the offset off.
+func (q *queue) remove(off int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n := off - q.base; n > 0 && n <= int64(len(q.buf)) {
+		q.buf = q.buf[n:]
+		if len(q.buf) == 0 {
+			q.buf = nil // release the array
+		}
+		q.base = off
+		q.notify()
+	}
+}
+
+// fail ends q with err after the bytes queued.
+func (q *queue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.eof = true
+	if q.err == nil {
+		q.err = err
+	}
+	q.notify()
+}
+
+// close ends q after the bytes queued.
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.eof = true
+	q.notify()
+}
@@ -0,0 +1,304 @@
+package poll
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+// Server serves the sessions of clients as an http.Handler.
+type Server struct {
+	// Auth, Path, Fallback and RealIP are as in ws.Server, Auth checking
+	// every request of a session and Path being where sessions are served.
+	Auth     func(username, password string) (user string, ok bool)
+	Path     string
+	Fallback http.Handler
+	RealIP   *ws.RealIP
+
+	// Modes are the modes the server supports besides the default one.
+	Modes []string
+
+	// Handler is called with the connection of each new session and the
+	// address of the client.
+	Handler func(conn *Conn, remoteAddr string)
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	closing  bool
+}
+
+// session is a Conn served to a client with its activity.
+type session struct {
+	conn   *Conn
+	active int       // requests in progress, guarded by Server.mu
+	last   time.Time // end of the last request, guarded by Server.mu
+}
+
+// ServeHTTP serves the authorized requests of sessions on s.Path and hands
+// the rest to s.Fallback.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := s.Path
+	if path == "" {
+		path = "/"
+	}
+	id := r.Header.Get(SessionHeader)
+	if r.URL.Path != path || id == "" {
+		s.fallback(w, r, http.StatusNotFound)
+		return
+	}
+	remoteAddr := s.RealIP.ClientIP(r)
+	user, ok := ws.Authorize(r, s.Auth)
+	if !ok {
+		log.Println("rejected unauthorized request from", remoteAddr)
+		s.fallback(w, r, http.StatusUnauthorized)
+		return
+	}
+	off, err := strconv.ParseInt(r.Header.Get(OffsetHeader), 10, 64)
+	if err != nil || off < 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	sess := s.get(id, user)
+	if sess == nil && r.Method == http.MethodPost && off == 0 {
+		if mode := r.Header.Get(ModeHeader); !transport.Supports(s.Modes, mode) {
+			log.Printf("rejected unsupported mode %q from %s", mode, remoteAddr)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		sess = s.open(r, id, user, remoteAddr)
+	}
+	if sess == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer s.put(sess)
+
+	switch r.Method {
+	case http.MethodPost:
+		s.upload(w, r, sess.conn, off)
+	case http.MethodGet:
+		if s.download(w, r, sess.conn, off) {
+			s.drop(id, sess)
+		}
+	case http.MethodDelete:
+		sess.conn.in.close()
+		sess.conn.Close()
+		s.drop(id, sess)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) fallback(w http.ResponseWriter, r *http.Request, code int) {
+	if s.Fallback != nil {
+		s.Fallback.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+// get returns the session id of user, counting the request in progress.
+func (s *Server) get(id, user string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.sessions[id]
+	if sess == nil || subtle.ConstantTimeCompare([]byte(sess.conn.user), []byte(user)) != 1 {
+		return nil
+	}
+	sess.active++
+	return sess
+}
+
+// put records the end of a request of sess.
+func (s *Server) put(sess *session) {
+	s.mu.Lock()
+	sess.active--
+	sess.last = time.Now()
+	s.mu.Unlock()
+}
+
+// drop forgets the session id.
+func (s *Server) drop(id string, sess *session) {
+	s.mu.Lock()
+	if s.sessions[id] == sess {
+		delete(s.sessions, id)
+	}
+	s.mu.Unlock()
+}
+
+// open starts the session id of user and hands its connection to Handler.
+func (s *Server) open(r *http.Request, id, user, remoteAddr string) *session {
+	conn := newConn()
+	conn.user = user
+	conn.mode = r.Header.Get(ModeHeader)
+	conn.raddr = addr(r.RemoteAddr)
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.laddr = la
+	} else {
+		conn.laddr = addr("")
+	}
+	sess := &session{conn: conn, active: 1}
+
+	s.mu.Lock()
+	if s.closing || s.sessions[id] != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*session)
+	}
+	if len(s.sessions) == 0 {
+		go s.expire(sessionTimeout)
+	}
+	s.sessions[id] = sess
+	s.mu.Unlock()
+
+	s.Handler(conn, remoteAddr)
+	return sess
+}
+
+// expire closes the sessions without requests for timeout until no session
+// is left.
+func (s *Server) expire(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		var idle []*Conn
+		s.mu.Lock()
+		n := len(s.sessions)
+		for id, sess := range s.sessions {
+			if sess.active == 0 && time.Since(sess.last) > timeout {
+				idle = append(idle, sess.conn)
+				delete(s.sessions, id)
+			}
+		}
+		s.mu.Unlock()
+		for _, c := range idle {
+			c.in.fail(errSession)
+			c.Close()
+		}
+		if n == len(idle) {
+			return
+		}
+	}
+}
+
+// upload adds the body of r at offset off to the bytes to read from conn.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, conn *Conn, off int64) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBatch+1))
+	if err != nil {
+		return
+	}
+	if len(body) > maxBatch {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	q := conn.in
+	q.mu.Lock()
+	deadline := time.Now().Add(pollTimeout)
+	for len(q.buf) >= maxQueued && q.wait(deadline, r.Context().Done()) {
+	}
+	full := len(q.buf) >= maxQueued
+	q.mu.Unlock()
+	if full { // the client sends again
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if !q.add(off, body, r.Header.Get(FinHeader) != "") {
+		http.Error(w, errOffset.Error(), http.StatusConflict)
+		return
+	}
+	if conn.mode != "" {
+		w.Header().Set(ModeHeader, conn.mode)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// download acknowledges the bytes written to conn before off and replies
+// with the following ones once there are any. It reports whether the client
+// received all the bytes of the closed conn, ending the session. After
+// CloseWrite, the session lasts until conn is closed.
+func (s *Server) download(w http.ResponseWriter, r *http.Request, conn *Conn, off int64) bool {
+	q := conn.out
+	q.remove(off)
+
+	q.mu.Lock()
+	if off < q.base || off > q.end() {
+		q.mu.Unlock()
+		http.Error(w, errOffset.Error(), http.StatusConflict)
+		return false
+	}
+	deadline := time.Now().Add(pollTimeout)
+	for len(q.buf) == 0 && !q.eof && q.wait(deadline, r.Context().Done()) {
+	}
+	n := len(q.buf)
+	if n > maxBatch {
+		n = maxBatch
+	}
+	data := append([]byte(nil), q.buf[:n]...)
+	fin := q.eof && n == len(q.buf)
+	q.mu.Unlock()
+
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	if fin {
+		h.Set(FinHeader, "1")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	select {
+	case <-conn.done:
+		return fin && n == 0
+	default:
+		return false
+	}
+}
+
+// Shutdown stops accepting sessions and waits for the open ones to be
+// closed. When ctx is done first, it closes the remaining ones.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.sessions)
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.sessions))
+			for _, sess := range s.sessions {
+				conns = append(conns, sess.conn)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.in.fail(errSession)
+				c.Close()
+			}
+			return ctx.Err()
+		}
+	}
+}
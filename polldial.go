@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/BigSully/shadowsocks-ws/poll"
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+// pollClient is the transport.Dialer of HTTP long polling with servers of
+// URLs such as http://key@host:port/path, which WebSocket servers serve at
+// the same path.
+type pollClient struct {
+	url    string // server URL without the key
+	key    string
+	dialer *poll.Dialer
+}
+
+func dialPoll(u *url.URL) (transport.Dialer, error) {
+	scheme := "http"
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		scheme = "https"
+	}
+	urlStr := fmt.Sprintf("%s://%s%s", scheme, u.Host, u.Path)
+	d := &poll.Dialer{Header: clientHeader()}
+	if scheme == "https" {
+		tlsConfig, err := ws.ClientTLSConfig(config.TLSCA, config.TLSServerName, config.TLSInsecure)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure dialer for %s: %v", urlStr, err)
+		}
+		d.TLSConfig = tlsConfig
+	}
+	proxy, err := clientProxy()
+	if err != nil {
+		return nil, err
+	}
+	d.Proxy = proxy
+	return &pollClient{url: urlStr, key: u.User.Username(), dialer: d}, nil
+}
+
+// Dial opens a session with the server in mode.
+func (c *pollClient) Dial(mode string) (net.Conn, error) {
+	conn, err := c.dialer.Dial(c.url, mode, ws.Auth(c.key, ""))
+	if err != nil {
+		return nil, err
+	}
+	if mode == transport.ModePacket {
+		return transport.NewPacketConn(conn), nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,241 @@
+// Package proxyproto accepts connections preceded by a PROXY protocol
+// header, version 1 or 2, as sent by load balancers such as HAProxy to
+// pass on the address of the client.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sigV2 starts a version 2 header.
+var sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidHeader is returned by reads from a connection not starting with
+// a valid header.
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// Listener wraps a listener whose connections start with a PROXY header.
+// The header is read with the first Read or RemoteAddr call, which report
+// the client address of the header from then on.
+type Listener struct {
+	net.Listener
+
+	// Trusted are the networks of the proxies sending headers. Headers of
+	// other peers are not parsed, so clients cannot fake their address.
+	// Nil trusts everybody.
+	Trusted []*net.IPNet
+
+	// Timeout limits the time to read the header. Zero means 10 seconds.
+	Timeout time.Duration
+}
+
+// Accept waits for the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &Conn{Conn: c, br: bufio.NewReader(c), timeout: timeout}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	if l.Trusted == nil {
+		return true
+	}
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection whose RemoteAddr is the client of the PROXY header.
+type Conn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	mu  sync.Mutex
+	rdl time.Time // read deadline set by the caller, guarded by mu
+
+	once sync.Once
+	src  net.Addr // nil for LOCAL and UNKNOWN headers
+	err  error
+}
+
+// init reads the header within the timeout of the listener, or the read
+// deadline of the caller if that comes first, which then applies again.
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		rdl := c.rdl
+		c.mu.Unlock()
+		dl := time.Now().Add(c.timeout)
+		if !rdl.IsZero() && rdl.Before(dl) {
+			dl = rdl
+		}
+		c.Conn.SetReadDeadline(dl)
+		c.src, c.err = readHeader(c.br)
+
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.rdl)
+		c.mu.Unlock()
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rdl = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Read reads the data following the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// CloseWrite closes the writing side of the connection if it supports that.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// RemoteAddr returns the client address of the header, or the peer address
+// if there is none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func readHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(sigV2)) // shorter than any header
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, sigV2):
+		return readV2(br)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readV1(br)
+	}
+	return nil, ErrInvalidHeader
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // longest valid header
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, ErrInvalidHeader
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (f[1] == "TCP4") {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads a binary header.
+func readV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL, e.g. health checks of the proxy
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	var ip net.IP
+	var port int
+	switch fam >> 4 {
+	case 1: // IPv4
+		if len(body) < 12 {
+			return nil, ErrInvalidHeader
+		}
+		ip, port = net.IP(body[0:4]), int(binary.BigEndian.Uint16(body[8:]))
+	case 2: // IPv6
+		if len(body) < 36 {
+			return nil, ErrInvalidHeader
+		}
+		ip, port = net.IP(body[0:16]), int(binary.BigEndian.Uint16(body[32:]))
+	default: // unspecified or unix socket, keep the peer address
+		return nil, nil
+	}
+	switch fam & 0xf {
+	case 1:
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	case 2:
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return nil, nil
+}
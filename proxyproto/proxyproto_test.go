@@ -0,0 +1,122 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accept sends data to l and returns the accepted connection.
+func accept(t *testing.T, l *Listener, data []byte) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Write(data)
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sc.Close() })
+	return sc
+}
+
+func listen(t *testing.T, trusted string) *Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	l := &Listener{Listener: ln}
+	if trusted != "" {
+		_, n, _ := net.ParseCIDR(trusted)
+		l.Trusted = []*net.IPNet{n}
+	}
+	return l
+}
+
+func v2(fam byte, addrs []byte) []byte {
+	b := append([]byte{}, sigV2...)
+	b = append(b, 0x21, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestHeaders(t *testing.T) {
+	ip4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ip6 := make([]byte, 36)
+	copy(ip6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ip6[32:], 56324)
+
+	for _, tc := range []struct {
+		name, header, addr string
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", ""},
+		{"v2 tcp4", string(v2(0x11, ip4)), "192.0.2.1:56324"},
+		{"v2 tcp6", string(v2(0x21, ip6)), "[2001:db8::1]:56324"},
+		{"v2 udp4", string(v2(0x12, ip4)), "192.0.2.1:56324"},
+	} {
+		l := listen(t, "")
+		c := accept(t, l, []byte(tc.header+"payload"))
+		want := tc.addr
+		if want == "" {
+			want = c.(*Conn).Conn.RemoteAddr().String()
+		}
+		if got := c.RemoteAddr().String(); got != want {
+			t.Errorf("%s: got address %s, want %s", tc.name, got, want)
+		}
+		if _, udp := c.RemoteAddr().(*net.UDPAddr); udp != strings.HasPrefix(tc.name, "v2 udp") {
+			t.Errorf("%s: got a %T", tc.name, c.RemoteAddr())
+		}
+		b := make([]byte, 7)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "payload" {
+			t.Errorf("%s: read %q, %v", tc.name, b, err)
+		}
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	l := listen(t, "")
+	c := accept(t, l, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if _, err := c.Read(make([]byte, 1)); err != ErrInvalidHeader {
+		t.Fatalf("expected ErrInvalidHeader, got %v", err)
+	}
+}
+
+func TestUntrustedPeer(t *testing.T) {
+	l := listen(t, "192.0.2.0/24")
+	c := accept(t, l, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	if _, ok := c.(*Conn); ok {
+		t.Fatal("parsing the header of an untrusted peer")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	l := listen(t, "")
+	l.Timeout = 5 * time.Second
+
+	// the deadline set before the header is read holds for the data after
+	c := accept(t, l, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	start := time.Now()
+	c.SetReadDeadline(start.Add(200 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || time.Since(start) > 2*time.Second {
+		t.Fatalf("got %v after %v, want a timeout", err, time.Since(start))
+	}
+
+	// and for the header itself
+	c = accept(t, l, []byte("PROXY TCP4"))
+	start = time.Now()
+	c.SetDeadline(start.Add(200 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); err == nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("got %v after %v, want a timeout", err, time.Since(start))
+	}
+}
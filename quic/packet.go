@@ -0,0 +1,217 @@
+package quic
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// Packets received but not read yet, per packet connection. More are
+// dropped like a full socket buffer would.
+const packetQueue = 64
+
+// Datagrams kept for streams whose packet connection does not exist yet,
+// as the first ones may overtake the header of the stream.
+const earlyQueue = 64
+
+// session is a QUIC connection with the packet connections of its streams,
+// to which it hands the datagrams received.
+type session struct {
+	qc *quicgo.Conn
+
+	mu      sync.Mutex
+	packets map[quicgo.StreamID]*PacketConn
+	early   []datagram // for streams without packet connection, oldest first
+}
+
+type datagram struct {
+	id quicgo.StreamID
+	b  []byte
+}
+
+func newSession(qc *quicgo.Conn) *session {
+	s := &session{qc: qc, packets: make(map[quicgo.StreamID]*PacketConn)}
+	if qc.ConnectionState().SupportsDatagrams.Remote {
+		go s.receive()
+	}
+	return s
+}
+
+// receive hands the datagrams received to the packet connections of the
+// streams they are prefixed with.
+func (s *session) receive() {
+	for {
+		b, err := s.qc.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		id, n := binary.Uvarint(b)
+		if n <= 0 {
+			continue
+		}
+		s.mu.Lock()
+		pc := s.packets[quicgo.StreamID(id)]
+		if pc == nil {
+			if len(s.early) == earlyQueue {
+				s.early = s.early[1:]
+			}
+			s.early = append(s.early, datagram{quicgo.StreamID(id), b[n:]})
+		}
+		s.mu.Unlock()
+		if pc != nil {
+			pc.deliver(b[n:])
+		}
+	}
+}
+
+// register adds pc to the packet connections and delivers the datagrams
+// received for it so far.
+func (s *session) register(pc *PacketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := pc.StreamID()
+	s.packets[id] = pc
+	early := s.early[:0]
+	for _, d := range s.early {
+		if d.id == id {
+			pc.deliver(d.b)
+		} else {
+			early = append(early, d)
+		}
+	}
+	s.early = early
+}
+
+// PacketConn carries packets for the peer of a Conn. Packets go as QUIC
+// datagrams prefixed with the stream ID of the Conn, or over the stream,
+// each prefixed with its length as a big-endian uint16, when they are too
+// large for a datagram or datagrams are not supported.
+type PacketConn struct {
+	*Conn
+
+	in   chan []byte
+	done chan struct{}
+	once sync.Once
+	rdl  time.Time // read deadline, guarded by rmu
+	rmu  sync.Mutex
+	wmu  sync.Mutex // serializes packets written to the stream
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// NewPacketConn returns a net.PacketConn sending and receiving packets for
+// the peer of c. Packets are read from and written to the peer of c
+// whatever the address.
+func NewPacketConn(c *Conn) *PacketConn {
+	pc := &PacketConn{Conn: c, in: make(chan []byte, packetQueue), done: make(chan struct{})}
+	c.sess.register(pc)
+	go pc.readStream()
+	return pc
+}
+
+func (pc *PacketConn) deliver(b []byte) {
+	select {
+	case pc.in <- b:
+	default:
+	}
+}
+
+// readStream delivers the packets sent over the stream until it ends, which
+// closes pc.
+func (pc *PacketConn) readStream() {
+	defer pc.Close()
+	b := make([]byte, 0xffff)
+	for {
+		n, err := transport.ReadPacket(pc.Conn, b)
+		if err != nil {
+			return
+		}
+		pc.deliver(append([]byte(nil), b[:n]...))
+	}
+}
+
+// ReadFrom reads the next packet into b. The part of the packet that does
+// not fit into b is discarded. A read deadline applies to the reads started
+// after it is set.
+func (pc *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	pc.rmu.Lock()
+	dl := pc.rdl
+	pc.rmu.Unlock()
+
+	var timeout <-chan time.Time
+	if !dl.IsZero() {
+		t := time.NewTimer(time.Until(dl))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-pc.in:
+		return copy(b, p), pc.RemoteAddr(), nil
+	case <-pc.done:
+		return 0, nil, io.EOF
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo sends b as one packet to the peer of the connection.
+func (pc *PacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if len(b) > 0xffff {
+		return 0, transport.ErrPacketTooLarge
+	}
+	select {
+	case <-pc.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	if pc.sess.qc.ConnectionState().SupportsDatagrams.Remote {
+		dg := make([]byte, binary.MaxVarintLen64+len(b))
+		n := binary.PutUvarint(dg, uint64(pc.StreamID()))
+		n += copy(dg[n:], b)
+		err := pc.sess.qc.SendDatagram(dg[:n])
+		if _, ok := err.(*quicgo.DatagramTooLargeError); !ok {
+			if err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+	}
+
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+	if err := transport.WritePacket(pc.Conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *PacketConn) SetReadDeadline(t time.Time) error {
+	pc.rmu.Lock()
+	pc.rdl = t
+	pc.rmu.Unlock()
+	return nil
+}
+
+func (pc *PacketConn) SetDeadline(t time.Time) error {
+	pc.SetReadDeadline(t)
+	return pc.Conn.SetWriteDeadline(t)
+}
+
+// Close stops the packets of pc and closes its stream.
+func (pc *PacketConn) Close() error {
+	pc.once.Do(func() {
+		close(pc.done)
+		pc.sess.mu.Lock()
+		delete(pc.sess.packets, pc.StreamID())
+		pc.sess.mu.Unlock()
+	})
+	return pc.Conn.Close()
+}
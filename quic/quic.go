@@ -0,0 +1,146 @@
+// Package quic carries byte streams and packets over QUIC. Each connection
+// is a stream of a QUIC connection shared with the other connections to the
+// same server, so that a lost packet only stalls the stream it belongs to.
+// Packet connections send their packets as QUIC datagrams where possible.
+//
+// A stream starts with a header naming the key of the client and the mode
+// of the connection, each prefixed with its length in one byte.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// NextProto is the ALPN protocol negotiated with servers.
+const NextProto = "ss"
+
+// Application error codes of QUIC connections and streams.
+const (
+	codeNoError      = 0
+	codeUnauthorized = 1
+	codeBadMode      = 2
+)
+
+// A Dialer connects to a QUIC server, multiplexing the connections over one
+// QUIC connection that is reestablished when lost.
+type Dialer struct {
+	// TLSConfig is used to connect to the server. A nil TLSConfig verifies
+	// the server against the system roots. NextProto is always offered.
+	TLSConfig *tls.Config
+
+	// KeepAlive is the interval of keep-alive packets, zero for none.
+	// IdleTimeout closes the QUIC connection after that long without
+	// packets from the server, zero meaning the default of 30 seconds.
+	KeepAlive   time.Duration
+	IdleTimeout time.Duration
+
+	mu   sync.Mutex // serializes dialing
+	sess *session
+}
+
+func (d *Dialer) session(addr string) (*session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.sess != nil && d.sess.qc.Context().Err() == nil {
+		return d.sess, nil
+	}
+	tlsConfig := &tls.Config{}
+	if d.TLSConfig != nil {
+		tlsConfig = d.TLSConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{NextProto}
+	qc, err := quicgo.DialAddr(context.Background(), addr, tlsConfig, &quicgo.Config{
+		KeepAlivePeriod: d.KeepAlive,
+		MaxIdleTimeout:  d.IdleTimeout,
+		EnableDatagrams: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.sess = newSession(qc)
+	return d.sess, nil
+}
+
+// Dial opens a stream in mode to the server at addr, authenticating with
+// key. The server refuses a wrong key or an unsupported mode by resetting
+// the stream, which the first Read reports.
+func (d *Dialer) Dial(addr, key, mode string) (*Conn, error) {
+	if len(key) > 255 || len(mode) > 255 {
+		return nil, errors.New("quic: key or mode too long")
+	}
+	s, err := d.session(addr)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.qc.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 0, 2+len(key)+len(mode))
+	hdr = append(hdr, byte(len(key)))
+	hdr = append(hdr, key...)
+	hdr = append(hdr, byte(len(mode)))
+	hdr = append(hdr, mode...)
+	if _, err := st.Write(hdr); err != nil {
+		st.CancelRead(codeNoError)
+		st.Close()
+		return nil, err
+	}
+	return &Conn{Stream: st, sess: s, mode: mode}, nil
+}
+
+// readHeader reads the key and mode from the start of r.
+func readHeader(r io.Reader) (key, mode string, err error) {
+	field := func() (string, error) {
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		_, err := io.ReadFull(r, b)
+		return string(b), err
+	}
+	if key, err = field(); err != nil {
+		return
+	}
+	mode, err = field()
+	return
+}
+
+// Conn is a net.Conn over a QUIC stream.
+type Conn struct {
+	*quicgo.Stream
+	sess *session
+	user string
+	mode string
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// Close ends the stream in both directions.
+func (c *Conn) Close() error {
+	c.Stream.CancelRead(codeNoError)
+	return c.Stream.Close()
+}
+
+// CloseWrite ends the stream of the local side. The peer reads io.EOF once
+// it has read everything written before.
+func (c *Conn) CloseWrite() error { return c.Stream.Close() }
+
+// User returns the user the server authorized the connection for.
+func (c *Conn) User() string { return c.user }
+
+// Mode returns the mode the client asked for.
+func (c *Conn) Mode() string { return c.mode }
+
+func (c *Conn) LocalAddr() net.Addr  { return c.sess.qc.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.sess.qc.RemoteAddr() }
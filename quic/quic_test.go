@@ -0,0 +1,191 @@
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// selfSigned returns a server certificate for host and a pool trusting it.
+func selfSigned(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+// serve starts s on a loopback port and returns its address, a dialer
+// trusting it and the connections s accepts.
+func serve(t *testing.T, s *Server) (string, *Dialer, <-chan *Conn) {
+	t.Helper()
+	cert, roots := selfSigned(t, "example.test")
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	conns := make(chan *Conn, 4)
+	s.Handler = func(c *Conn, _ string) {
+		t.Cleanup(func() { c.Close() })
+		conns <- c
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(pc)
+	t.Cleanup(func() {
+		s.Close()
+		pc.Close()
+	})
+	d := &Dialer{TLSConfig: &tls.Config{RootCAs: roots, ServerName: "example.test"}}
+	return pc.LocalAddr().String(), d, conns
+}
+
+func TestEarlyDatagrams(t *testing.T) {
+	addr, d, conns := serve(t, &Server{Modes: []string{"udp"}})
+	c, err := d.Dial(addr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("x"))
+	server := (<-conns).sess
+
+	// datagrams overtaking the header of their stream wait for it
+	st, err := c.sess.qc.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for _, b := range []string{"one", "two", "three"} {
+		dg := binary.AppendUvarint(nil, uint64(st.StreamID()))
+		if err := c.sess.qc.SendDatagram(append(dg, b...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		server.mu.Lock()
+		n := len(server.early)
+		server.mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d early datagrams queued, want 3", n)
+		}
+	}
+	if _, err := st.Write([]byte("\x00\x03udp")); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := NewPacketConn(<-conns)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"one", "two", "three"} {
+		b := make([]byte, 16)
+		n, _, err := pc.ReadFrom(b)
+		if err != nil || string(b[:n]) != want {
+			t.Fatalf("read %q, %v, want %q", b[:n], err, want)
+		}
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.early) != 0 {
+		t.Fatalf("%d datagrams left in the early queue", len(server.early))
+	}
+}
+
+func TestAuth(t *testing.T) {
+	addr, d, conns := serve(t, &Server{
+		Auth: func(key string) (string, bool) { return "alice", key == "secret" },
+	})
+
+	c, err := d.Dial(addr, "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if u := (<-conns).User(); u != "alice" {
+		t.Fatalf("user %q, want alice", u)
+	}
+
+	// a wrong key resets its own stream only
+	wrong, err := d.Dial(addr, "wrong", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serr *quicgo.StreamError
+	if _, err := wrong.Read(make([]byte, 1)); !errors.As(err, &serr) || serr.ErrorCode != codeUnauthorized {
+		t.Fatalf("got %v, want the stream reset as unauthorized", err)
+	}
+	if err := c.sess.qc.Context().Err(); err != nil {
+		t.Fatalf("QUIC connection closed: %v", err)
+	}
+	c, err = d.Dial(addr, "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.sess != wrong.sess {
+		t.Fatal("redialed the QUIC connection")
+	}
+	if u := (<-conns).User(); u != "alice" {
+		t.Fatalf("user %q, want alice", u)
+	}
+}
+
+func TestServeNilTLSConfig(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if err := (&Server{}).Serve(pc); err == nil {
+		t.Fatal("served without a certificate")
+	}
+}
+
+func TestUnsupportedMode(t *testing.T) {
+	addr, d, _ := serve(t, &Server{})
+	c, err := d.Dial(addr, "", "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatalf("got %v, want the stream reset", err)
+	}
+}
@@ -0,0 +1,197 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// Time allowed to a client to send the header of a stream.
+const headerTimeout = 10 * time.Second
+
+// Server accepts streams of QUIC connections as connections.
+type Server struct {
+	// TLSConfig provides the certificate of the server. NextProto is the
+	// only protocol negotiated.
+	TLSConfig *tls.Config
+
+	// Auth returns the user the key sent by a client belongs to. A nil
+	// Auth accepts every client.
+	Auth func(key string) (user string, ok bool)
+
+	// Modes are the modes the server supports besides the default one.
+	Modes []string
+
+	// KeepAlive is the interval of keep-alive packets, zero for none.
+	// IdleTimeout closes QUIC connections after that long without packets
+	// from the client, zero meaning the default of 30 seconds.
+	KeepAlive   time.Duration
+	IdleTimeout time.Duration
+
+	// Handler is called with each connection and the address of the
+	// client.
+	Handler func(conn *Conn, remoteAddr string)
+
+	mu      sync.Mutex
+	l       *quicgo.Listener
+	qcs     map[*quicgo.Conn]struct{}
+	conns   sync.WaitGroup // streams handed to Handler and still open
+	closing bool
+}
+
+// Serve accepts QUIC connections on the UDP socket pc and serves their
+// streams. It returns once Shutdown is called or pc fails.
+func (s *Server) Serve(pc net.PacketConn) error {
+	if s.TLSConfig == nil {
+		return errors.New("quic: Server.TLSConfig is nil")
+	}
+	tlsConfig := s.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{NextProto}
+	l, err := quicgo.Listen(pc, tlsConfig, &quicgo.Config{
+		KeepAlivePeriod: s.KeepAlive,
+		MaxIdleTimeout:  s.IdleTimeout,
+		EnableDatagrams: true,
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.l = l
+	if s.qcs == nil {
+		s.qcs = make(map[*quicgo.Conn]struct{})
+	}
+	closing := s.closing
+	s.mu.Unlock()
+	if closing {
+		l.Close()
+	}
+
+	for {
+		qc, err := l.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go s.serveConn(qc)
+	}
+}
+
+func (s *Server) serveConn(qc *quicgo.Conn) {
+	s.mu.Lock()
+	s.qcs[qc] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.qcs, qc)
+		s.mu.Unlock()
+	}()
+
+	sess := newSession(qc)
+	for {
+		st, err := qc.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go s.serveStream(sess, st)
+	}
+}
+
+func (s *Server) serveStream(sess *session, st *quicgo.Stream) {
+	remoteAddr := sess.qc.RemoteAddr().String()
+	st.SetReadDeadline(time.Now().Add(headerTimeout))
+	key, mode, err := readHeader(st)
+	st.SetReadDeadline(time.Time{})
+	if err != nil {
+		st.CancelRead(codeNoError)
+		st.CancelWrite(codeNoError)
+		return
+	}
+
+	user := ""
+	if s.Auth != nil {
+		var ok bool
+		if user, ok = s.Auth(key); !ok {
+			log.Println("rejected unauthorized client", remoteAddr)
+			st.CancelRead(codeUnauthorized)
+			st.CancelWrite(codeUnauthorized)
+			return
+		}
+	}
+	if !transport.Supports(s.Modes, mode) {
+		log.Printf("rejected unsupported mode %q from %s", mode, remoteAddr)
+		st.CancelRead(codeBadMode)
+		st.CancelWrite(codeBadMode)
+		return
+	}
+
+	s.mu.Lock()
+	closing := s.closing
+	if !closing {
+		s.conns.Add(1)
+	}
+	s.mu.Unlock()
+	if closing {
+		st.CancelRead(codeNoError)
+		st.CancelWrite(codeNoError)
+		return
+	}
+	go func() {
+		<-st.Context().Done() // the write side is closed
+		s.conns.Done()
+	}()
+
+	s.Handler(&Conn{Stream: st, sess: sess, user: user, mode: mode}, remoteAddr)
+}
+
+// Close closes the listener and all QUIC connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	l := s.l
+	qcs := make([]*quicgo.Conn, 0, len(s.qcs))
+	for qc := range s.qcs {
+		qcs = append(qcs, qc)
+	}
+	s.mu.Unlock()
+
+	for _, qc := range qcs {
+		qc.CloseWithError(codeNoError, "")
+	}
+	if l != nil {
+		return l.Close()
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and streams and waits for the open
+// streams to be closed by their handlers. When ctx is done first, it closes
+// the QUIC connections.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	l := s.l
+	s.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.Close()
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
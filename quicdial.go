@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/BigSully/shadowsocks-ws/quic"
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+// quicClient is the transport.Dialer of QUIC servers with URLs such as
+// quic://key@host:port. All its connections share one QUIC connection.
+type quicClient struct {
+	addr   string
+	key    string
+	dialer *quic.Dialer
+}
+
+func dialQUIC(u *url.URL) (transport.Dialer, error) {
+	if config.Proxy != "" { // HTTP CONNECT and SOCKS5 proxies relay TCP only
+		return nil, fmt.Errorf("QUIC server %s cannot be reached through -proxy", u.Host)
+	}
+	tlsConfig, err := ws.ClientTLSConfig(config.TLSCA, config.TLSServerName, config.TLSInsecure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure dialer for %s: %v", u.Host, err)
+	}
+	d := &quic.Dialer{TLSConfig: tlsConfig, KeepAlive: config.Keepalive.Interval}
+	if config.Keepalive.Interval > 0 && config.Keepalive.Timeout > 0 {
+		d.IdleTimeout = config.Keepalive.Interval + config.Keepalive.Timeout
+	}
+	return &quicClient{addr: u.Host, key: u.User.Username(), dialer: d}, nil
+}
+
+// Dial opens a stream to the server in mode.
+func (c *quicClient) Dial(mode string) (net.Conn, error) {
+	conn, err := c.dialer.Dial(c.addr, c.key, mode)
+	if err != nil {
+		return nil, err
+	}
+	if mode == transport.ModePacket {
+		return quic.NewPacketConn(conn), nil
+	}
+	return conn, nil
+}
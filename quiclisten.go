@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+
+	"github.com/BigSully/shadowsocks-ws/quic"
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+func init() {
+	transport.Register("quic", dialQUIC, listenQUIC)
+}
+
+// quicListener is the transport.Listener of a QUIC server.
+type quicListener struct {
+	*transport.Queue
+	srv *quic.Server
+	pc  net.PacketConn
+}
+
+func listenQUIC(u *url.URL, users map[string]string) (transport.Listener, error) {
+	if config.TLSCert == "" {
+		return nil, errors.New("quic:// needs -tls-cert and -tls-key")
+	}
+	kp, err := ws.LoadKeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	go watchKeyPair(kp)
+
+	srv := &quic.Server{
+		TLSConfig: kp.TLSConfig(),
+		Modes:     []string{transport.ModeMux, transport.ModePacket},
+		KeepAlive: config.Keepalive.Interval,
+	}
+	if config.Keepalive.Interval > 0 && config.Keepalive.Timeout > 0 {
+		srv.IdleTimeout = config.Keepalive.Interval + config.Keepalive.Timeout
+	}
+	if len(users) > 0 {
+		auth := ws.KeyAuth(users)
+		srv.Auth = func(key string) (string, bool) { return auth(key, "") }
+	} else {
+		logf("no client keys configured, accepting all QUIC clients")
+	}
+
+	pc, err := net.ListenPacket("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	ql := &quicListener{Queue: transport.NewQueue(), srv: srv, pc: pc}
+	srv.Handler = func(c *quic.Conn, remoteAddr string) {
+		var conn net.Conn = c
+		if c.Mode() == transport.ModePacket {
+			conn = quic.NewPacketConn(c)
+		}
+		ql.Put(transport.Accepted(conn, c.User(), c.Mode(), remoteAddr))
+	}
+	go func() {
+		srv.Serve(pc)
+		ql.Stop(transport.ErrClosed)
+	}()
+	return ql, nil
+}
+
+func (l *quicListener) Close() error {
+	l.Stop(transport.ErrClosed)
+	l.srv.Close()
+	return l.pc.Close()
+}
+
+func (l *quicListener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+// Shutdown stops the server gracefully, see quic.Server.Shutdown.
+func (l *quicListener) Shutdown(ctx context.Context) error {
+	return l.srv.Shutdown(ctx)
+}
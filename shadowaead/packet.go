@@ -53,7 +53,6 @@ func Unpack(dst, pkt []byte, ciph Cipher) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	internal.AddSalt(salt)
 	if len(pkt) < saltSize+aead.Overhead() {
 		return nil, ErrShortPacket
 	}
@@ -61,7 +60,11 @@ func Unpack(dst, pkt []byte, ciph Cipher) ([]byte, error) {
 		return nil, io.ErrShortBuffer
 	}
 	b, err := aead.Open(dst[:0], _zerononce[:aead.NonceSize()], pkt[saltSize:], nil)
-	return b, err
+	if err != nil {
+		return nil, err
+	}
+	internal.AddSalt(salt) // only remember salts of authentic packets, so that a wrong key can be retried
+	return b, nil
 }
 
 type packetConn struct {
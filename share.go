@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/proxyproto"
+	"github.com/BigSully/shadowsocks-ws/transport"
+)
+
+// Kinds of protocols sharing a port.
+type protoKind int
+
+const (
+	kindHTTP protoKind = iota // HTTP or TLS, for WebSocket
+	kindSS                    // native Shadowsocks
+)
+
+// Time allowed to a client to send enough to tell its protocol.
+const sniffTimeout = 10 * time.Second
+
+var (
+	sharedMu   sync.Mutex
+	sharedCond = sync.NewCond(&sharedMu)             // broadcast when a server registers
+	shared     = make(map[string]*sharedListener)    // by sharedKey
+	expected   = make(map[string]map[protoKind]bool) // by sharedKey, see expectShared
+)
+
+// sharedListener is a TCP listener whose connections are handed to the
+// servers listening on its address, telling their protocols apart by the
+// first bytes when there are several.
+type sharedListener struct {
+	addr string // sharedKey of the address
+	l    net.Listener
+	subs map[protoKind]*subListener // guarded by sharedMu
+}
+
+// sharedKey returns the same key for the spellings of a TCP address, such
+// as ":443" and "0.0.0.0:443".
+func sharedKey(addr string) string {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return addr
+	}
+	if a.IP == nil || a.IP.IsUnspecified() {
+		return ":" + strconv.Itoa(a.Port)
+	}
+	return a.String()
+}
+
+// expectShared records that a server of kind is going to listen on addr,
+// before any server listens there. Until it does, connections to addr are
+// still told apart and those of kind wait for it.
+func expectShared(addr string, kind protoKind) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	key := sharedKey(addr)
+	if expected[key] == nil {
+		expected[key] = make(map[protoKind]bool)
+	}
+	expected[key][kind] = true
+}
+
+// subListener accepts the connections of one kind of a sharedListener.
+type subListener struct {
+	parent *sharedListener
+	kind   protoKind
+	conns  chan net.Conn
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// expectServer calls expectShared for the server at addr, a native address
+// or a transport URL, if it listens on TCP.
+func expectServer(addr string) {
+	if !transport.Supported(addr) {
+		expectShared(addr, kindSS)
+		return
+	}
+	u, err := url.Parse(strings.Trim(addr, "'"))
+	if err != nil {
+		return
+	}
+	switch u.Scheme {
+	case "ws", "wss", "http", "https", "h2":
+		expectShared(u.Host, kindHTTP)
+	}
+}
+
+// listenShared listens on the TCP address addr for connections of kind.
+// Servers of different kinds may listen on the same address.
+func listenShared(addr string, kind protoKind) (net.Listener, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	key := sharedKey(addr)
+	sl := shared[key]
+	if sl == nil {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		l = keepAliveListener{l.(*net.TCPListener)}
+		if config.ProxyProtocol {
+			l = &proxyproto.Listener{Listener: l, Trusted: config.TrustedProxies}
+		}
+		sl = &sharedListener{addr: key, l: l, subs: make(map[protoKind]*subListener)}
+		shared[key] = sl
+		go sl.serve()
+	}
+	if _, ok := sl.subs[kind]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: sl.l.Addr(), Err: errAddrInUse}
+	}
+	sub := &subListener{parent: sl, kind: kind, conns: make(chan net.Conn), done: make(chan struct{})}
+	sl.subs[kind] = sub
+	sharedCond.Broadcast()
+	return sub, nil
+}
+
+var errAddrInUse = &net.AddrError{Err: "address already in use by a server of the same protocol"}
+
+func (sl *sharedListener) serve() {
+	for {
+		c, err := sl.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			sharedMu.Lock()
+			for _, sub := range sl.subs {
+				sub.close()
+			}
+			sharedCond.Broadcast()
+			sharedMu.Unlock()
+			return
+		}
+		go sl.dispatch(c)
+	}
+}
+
+// dispatch hands c to the server of its protocol.
+func (sl *sharedListener) dispatch(c net.Conn) {
+	sharedMu.Lock()
+	var only *subListener
+	if len(sl.subs) == 1 && len(expected[sl.addr]) <= 1 {
+		for _, sub := range sl.subs {
+			only = sub
+		}
+	}
+	sharedMu.Unlock()
+
+	sub := only
+	if sub == nil {
+		br := bufio.NewReader(c)
+		c.SetReadDeadline(time.Now().Add(sniffTimeout))
+		hdr, err := br.Peek(6)
+		c.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.Close()
+			return
+		}
+		kind := kindSS
+		if isHTTP(hdr) || isTLS(hdr) {
+			kind = kindHTTP
+		}
+		sub = sl.sub(kind)
+		if sub == nil {
+			c.Close()
+			return
+		}
+		c = &sniffedConn{Conn: c, r: br}
+	}
+
+	select {
+	case sub.conns <- c:
+	case <-sub.done:
+		c.Close()
+	}
+}
+
+// sub returns the server of kind, waiting for an expected one to register.
+func (sl *sharedListener) sub(kind protoKind) *subListener {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	timeout := false
+	t := time.AfterFunc(sniffTimeout, func() {
+		sharedMu.Lock()
+		timeout = true
+		sharedCond.Broadcast()
+		sharedMu.Unlock()
+	})
+	defer t.Stop()
+	for sl.subs[kind] == nil && expected[sl.addr][kind] && shared[sl.addr] == sl && !timeout {
+		sharedCond.Wait()
+	}
+	return sl.subs[kind]
+}
+
+// httpMethods start HTTP/1 requests and the HTTP/2 connection preface.
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD"), []byte("POST"), []byte("PUT "), []byte("DELE"),
+	[]byte("OPTI"), []byte("PATC"), []byte("CONN"), []byte("TRAC"), []byte("PRI "),
+}
+
+func isHTTP(hdr []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(hdr, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTLS reports whether hdr starts a TLS record of a ClientHello, which a
+// random salt matches with a chance of about 2^-34.
+func isTLS(hdr []byte) bool {
+	return hdr[0] == 0x16 && hdr[1] == 0x03 && hdr[2] <= 0x04 && hdr[3] < 0x40 && hdr[5] == 0x01
+}
+
+// keepAliveListener enables TCP keep-alives on accepted connections.
+type keepAliveListener struct {
+	*net.TCPListener
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	c.SetKeepAlive(true)
+	return c, nil
+}
+
+// sniffedConn replays the bytes read to tell the protocol.
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *sniffedConn) CloseWrite() error          { return closeWrite(c.Conn) }
+
+func (sub *subListener) close() {
+	sub.doneOnce.Do(func() { close(sub.done) })
+}
+
+func (sub *subListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-sub.conns:
+		return c, nil
+	case <-sub.done:
+		return nil, errClosedListener
+	}
+}
+
+var errClosedListener = &net.OpError{Op: "accept", Net: "tcp", Err: &net.AddrError{Err: "use of closed listener"}}
+
+// Close stops the server of the kind, and the TCP listener with the last
+// one.
+func (sub *subListener) Close() error {
+	sub.close()
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	sl := sub.parent
+	if sl.subs[sub.kind] != sub {
+		return nil
+	}
+	delete(sl.subs, sub.kind)
+	if len(sl.subs) > 0 {
+		return nil
+	}
+	delete(shared, sl.addr)
+	return sl.l.Close()
+}
+
+func (sub *subListener) Addr() net.Addr { return sub.parent.l.Addr() }
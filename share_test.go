@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniff(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x42}, 6)
+	for _, tc := range []struct {
+		hdr       string
+		http, tls bool
+	}{
+		{"GET / ", true, false},
+		{"POST /", true, false},
+		{"PRI * ", true, false}, // HTTP/2 preface
+		{"\x16\x03\x01\x02\x00\x01", false, true},
+		{"\x16\x03\x03\x00\x50\x01", false, true},
+		{"\x16\x03\x05\x02\x00\x01", false, false}, // no such TLS version
+		{"\x16\x03\x01\x02\x00\x02", false, false}, // not a ClientHello
+		{"get / ", false, false},
+		{string(salt), false, false},
+	} {
+		hdr := []byte(tc.hdr)
+		if got := isHTTP(hdr); got != tc.http {
+			t.Errorf("isHTTP(%q) = %v", hdr, got)
+		}
+		if got := isTLS(hdr); got != tc.tls {
+			t.Errorf("isTLS(%q) = %v", hdr, got)
+		}
+	}
+}
+
+func TestSharedKey(t *testing.T) {
+	for addr, want := range map[string]string{
+		":443":          ":443",
+		"0.0.0.0:443":   ":443",
+		"[::]:443":      ":443",
+		"127.0.0.1:443": "127.0.0.1:443",
+	} {
+		if got := sharedKey(addr); got != want {
+			t.Errorf("sharedKey(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+// freePort returns a TCP port free on all addresses.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// send connects to l and sends b.
+func send(t *testing.T, l net.Listener, b []byte) {
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Write(b)
+}
+
+// accepted returns the connections accepted from l.
+func accepted(l net.Listener) <-chan net.Conn {
+	ch := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				close(ch)
+				return
+			}
+			ch <- c
+		}
+	}()
+	return ch
+}
+
+// expectRead checks that the next connection from ch starts with b.
+func expectRead(t *testing.T, ch <-chan net.Conn, b []byte) {
+	t.Helper()
+	select {
+	case c := <-ch:
+		defer c.Close()
+		got := make([]byte, len(b))
+		if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, b) {
+			t.Fatalf("read %q, %v, want %q", got, err, b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection")
+	}
+}
+
+func TestListenShared(t *testing.T) {
+	port := freePort(t)
+	ssl, err := listenShared("0.0.0.0:"+port, kindSS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpl, err := listenShared(":"+port, kindHTTP)
+	if err != nil {
+		t.Fatalf("second server on the same port: %v", err)
+	}
+	if _, err := listenShared(":"+port, kindSS); err == nil {
+		t.Fatal("two native servers on the same port")
+	}
+	ss, http := accepted(ssl), accepted(httpl)
+
+	req := []byte("GET / HTTP/1.1\r\n\r\n")
+	send(t, httpl, req)
+	expectRead(t, http, req)
+	stream := bytes.Repeat([]byte{0x42}, 64)
+	send(t, ssl, stream)
+	expectRead(t, ss, stream)
+
+	ssl.Close()
+	httpl.Close()
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		t.Fatalf("port still in use after closing: %v", err)
+	}
+	l.Close()
+}
+
+func TestDispatchExpected(t *testing.T) {
+	addr := "127.0.0.1:" + freePort(t)
+	expectShared(addr, kindHTTP)
+	expectShared(addr, kindSS)
+	t.Cleanup(func() {
+		sharedMu.Lock()
+		delete(expected, sharedKey(addr))
+		sharedMu.Unlock()
+	})
+
+	httpl, err := listenShared(addr, kindHTTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpl.Close()
+	http := accepted(httpl)
+
+	// a native client arriving before its server is held for it
+	stream := bytes.Repeat([]byte{0x42}, 64)
+	send(t, httpl, stream)
+	time.Sleep(100 * time.Millisecond)
+	ssl, err := listenShared(addr, kindSS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ssl.Close()
+	expectRead(t, accepted(ssl), stream)
+	select {
+	case c := <-http:
+		t.Fatalf("HTTP server got %v", c.RemoteAddr())
+	default:
+	}
+}
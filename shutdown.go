@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	shutdownMu sync.Mutex
+	shutdowns  []func(ctx context.Context) error
+)
+
+// onShutdown registers f to stop a server gracefully on shutdown.
+func onShutdown(f func(ctx context.Context) error) {
+	shutdownMu.Lock()
+	shutdowns = append(shutdowns, f)
+	shutdownMu.Unlock()
+}
+
+// shutdown stops all servers, giving their connections up to grace to end.
+func shutdown(grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	shutdownMu.Lock()
+	fs := shutdowns
+	shutdownMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, f := range fs {
+		wg.Add(1)
+		go func(f func(context.Context) error) {
+			defer wg.Done()
+			if err := f(ctx); err != nil {
+				logf("shutdown: %v", err)
+			}
+		}(f)
+	}
+	wg.Wait()
+}
@@ -1,14 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"net/url"
-	"strings"
 	"time"
 
-	"github.com/BigSully/shadowsocks-ws/ws"
+	"github.com/BigSully/shadowsocks-ws/transport"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
@@ -37,16 +36,35 @@ func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(
 		return
 	}
 
-	u, err := url.Parse(strings.Trim(server, "'"))
+	d, err := newDialer(server)
 	if err != nil {
-		panic(err)
+		logf("%v", err)
+		return
+	}
+	ed, zeroRTT := d.(transport.EarlyDialer)
+	if config.ZeroRTT && !zeroRTT {
+		logf("-zero-rtt is not supported by %s", server)
+	}
+	zeroRTT = zeroRTT && config.ZeroRTT
+
+	// encrypt a connection to the server, compressing first if agreed
+	secure := func(conn net.Conn, err error) (net.Conn, error) {
+		if err != nil {
+			return nil, err
+		}
+		return compressStream(shadow(conn), conn), nil
 	}
 
-	urlStr := fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, u.Path)
-	key := u.User.Username()
-	//urlStr="ws://localhost:3000/"
-	fmt.Println(urlStr)
-	fmt.Println(key)
+	var mc *muxClient
+	if config.Mux > 0 {
+		mc = newMuxClient(config.Mux, func() (net.Conn, error) {
+			conn, err := d.Dial(transport.ModeMux)
+			if err != nil {
+				return nil, err
+			}
+			return muxCarrier(shadow(conn), conn), nil
+		})
+	}
 
 	for {
 		c, err := l.Accept()
@@ -79,98 +97,180 @@ func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(
 				return
 			}
 
-			conn, err := ws.Dial(urlStr, ws.Auth(key, ""))
-
+			var rc net.Conn
+			switch {
+			case mc != nil:
+				rc, err = mc.Open()
+			case zeroRTT:
+				rc, err = dialEarly(ed, shadow, c, tgt)
+			default:
+				rc, err = secure(d.Dial(transport.ModeStream))
+			}
 			if err != nil {
-				logf("failed to connect to server ", err)
+				logf("failed to connect to server: %v", err)
 				return
 			}
-			defer conn.Close()
-			go conn.Ping()
+			defer rc.Close()
+			compressFor(rc, tgt)
 
-			if _, err = conn.WriteAddress(tgt); err != nil {
-				return
+			if !zeroRTT { // sent along with the upgrade otherwise
+				if _, err = rc.Write(tgt); err != nil {
+					logf("failed to send target address: %v", err)
+					return
+				}
 			}
 
 			logf("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, tgt)
-
-			relayws(*conn, c)
+			sum := relay(c, rc)
+			logf("proxy %s <-> %s <-> %s closed: %v", c.RemoteAddr(), server, tgt, sum)
 		}()
 	}
 }
 
-// Listen on addr for incoming connections.
-func tcpRemote(addr string, shadow func(net.Conn) net.Conn) {
-	u, err := url.Parse(strings.Trim(addr, "'"))
+// Listen on addr for incoming connections of users.
+func tcpRemote(addr string, users *userTable) {
+	var l transport.Listener
+	var err error
+	if transport.Supported(addr) {
+		l, err = transport.Listen(addr, users.keys())
+	} else {
+		l, err = listenSS(addr, users)
+	}
 	if err != nil {
-		panic(err)
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	if s, ok := l.(transport.Shutdowner); ok {
+		onShutdown(s.Shutdown)
 	}
 
-	//key := u.User.Username()
-	host := u.Host
+	logf("listening on %s", l.Addr())
+	for {
+		c, err := l.Accept()
+		if err == transport.ErrClosed {
+			return
+		}
+		if err != nil {
+			logf("failed to accept: %v", err)
+			return
+		}
+		go serveConn(c, users)
+	}
+}
 
-	ws.Listen(host, func(c *ws.Conn, remoteAddr string) {
-		go func() {
-			defer c.Close()
+// serveConn serves the connection c of a client according to its mode.
+func serveConn(c net.Conn, users *userTable) {
+	defer c.Close()
 
-			r, err := c.ReadAddress()
-			if err != nil {
-				logf("error to read target address: %v", err)
-				return
-			}
+	remoteAddr := transport.ClientAddr(c)
+	usr := users.byName[transport.User(c)]
+	if usr == nil {
+		logf("unknown user %q from %s", transport.User(c), remoteAddr)
+		return
+	}
 
-			tgt, err := socks.ReadAddr(r)
-			if err != nil {
-				logf("failed to get target address: %v", err)
-				return
-			}
+	switch transport.Mode(c) {
+	case transport.ModePacket:
+		serveUDP(c.(net.PacketConn), usr)
+	case transport.ModeMux:
+		serveMux(muxCarrier(usr.ciph.StreamConn(c), c), remoteAddr, usr)
+	default:
+		handleTCP(compressStream(usr.ciph.StreamConn(c), c), remoteAddr, usr)
+	}
+}
 
-			rc, err := net.Dial("tcp", tgt.String())
-			if err != nil {
-				logf("failed to connect to target: %v", err)
-				return
-			}
-			defer rc.Close()
-			rc.(*net.TCPConn).SetKeepAlive(true)
+// Read the target address from the decrypted connection c of usr and proxy to
+// it.
+func handleTCP(c net.Conn, remoteAddr string, usr *user) {
+	tgt, err := socks.ReadAddr(c)
+	if err != nil {
+		logf("failed to get target address: %v", err)
+		return
+	}
+	compressFor(c, tgt)
 
-			logf("proxy %s <-> %s", remoteAddr, tgt)
-			relayws(*c, rc)
-		}()
-	})
+	rc, err := net.Dial("tcp", tgt.String())
+	if err != nil {
+		logf("failed to connect to target: %v", err)
+		return
+	}
+	defer rc.Close()
+	rc.(*net.TCPConn).SetKeepAlive(true)
+
+	logf("proxy %s <-> %s (user %s)", remoteAddr, tgt, usr)
+	sum := relay(c, rc)
+	totalUp, totalDown := usr.count(sum.up, sum.down)
+	logf("proxy %s <-> %s (user %s) closed: %v (total %d up, %d down)", remoteAddr, tgt, usr, sum, totalUp, totalDown)
 }
 
-func relayws(left ws.Conn, right net.Conn) {
-	go func() {
-		left.ReadFrom(right)
-		right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
-	}()
-	left.WriteTo(right)
-	right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
+// relaySummary describes a finished relay.
+type relaySummary struct {
+	up, down int64 // bytes copied from the client to the target and back
+	duration time.Duration
+	reason   string // why the relay ended
 }
 
-// relay copies between left and right bidirectionally. Returns number of
-// bytes copied from right to left, from left to right, and any error occurred.
-func relay(left, right net.Conn) (int64, int64, error) {
+func (s relaySummary) String() string {
+	return fmt.Sprintf("%d bytes up, %d bytes down in %v, %s", s.up, s.down, s.duration.Round(time.Millisecond), s.reason)
+}
+
+// relay copies between client and target bidirectionally. A direction
+// ending with EOF closes the writing side of its destination, leaving the
+// other direction be, while an error in either stops both.
+func relay(client, target net.Conn) relaySummary {
+	start := time.Now()
 	type res struct {
-		N   int64
-		Err error
+		up  bool
+		n   int64
+		err error
+	}
+	ch := make(chan res, 2)
+	copyTo := func(dst, src net.Conn, up bool) {
+		n, err := io.Copy(dst, src)
+		if err != nil || closeWrite(dst) != nil {
+			dst.SetDeadline(time.Now()) // wake up the other goroutine blocking on dst
+			src.SetDeadline(time.Now()) // wake up the other goroutine blocking on src
+		}
+		ch <- res{up, n, err}
 	}
-	ch := make(chan res)
+	go copyTo(target, client, true)
+	go copyTo(client, target, false)
 
-	go func() {
-		n, err := io.Copy(right, left)
-		right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
-		left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
-		ch <- res{n, err}
-	}()
+	var s relaySummary
+	for i := 0; i < 2; i++ {
+		r := <-ch
+		if r.up {
+			s.up = r.n
+		} else {
+			s.down = r.n
+		}
+		if i == 0 { // the direction that ended the relay
+			s.reason = closeReason(r.up, r.err)
+		}
+	}
+	s.duration = time.Since(start)
+	return s
+}
 
-	n, err := io.Copy(left, right)
-	right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
-	left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
-	rs := <-ch
+// closeWrite shuts down the writing side of c if c supports that.
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
 
-	if err == nil {
-		err = rs.Err
+// closeReason describes the end of the direction of a relay that ended first
+// with err, up from the client to the target.
+func closeReason(up bool, err error) string {
+	switch {
+	case err == nil && up:
+		return "closed by client"
+	case err == nil:
+		return "closed by target"
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timed out"
 	}
-	return n, rs.N, err
+	return "error: " + err.Error()
 }
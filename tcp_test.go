@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestCloseReason(t *testing.T) {
+	for _, tc := range []struct {
+		up   bool
+		err  error
+		want string
+	}{
+		{true, nil, "closed by client"},
+		{false, nil, "closed by target"},
+		{true, os.ErrDeadlineExceeded, "timed out"},
+		{false, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, "timed out"},
+		{false, errors.New("reset"), "error: reset"},
+	} {
+		if got := closeReason(tc.up, tc.err); got != tc.want {
+			t.Errorf("closeReason(%v, %v) = %q, want %q", tc.up, tc.err, got, tc.want)
+		}
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestRelay(t *testing.T) {
+	client, clientLeg := tcpPair(t)
+	targetLeg, target := tcpPair(t)
+	req := bytes.Repeat([]byte("q"), 100)
+	resp := bytes.Repeat([]byte("r"), 3000)
+
+	go func() {
+		// the target answers once the request is complete
+		got, _ := io.ReadAll(target)
+		if bytes.Equal(got, req) {
+			target.Write(resp)
+		}
+		target.Close()
+	}()
+	done := make(chan relaySummary, 1)
+	go func() { done <- relay(clientLeg, targetLeg) }()
+
+	client.Write(req)
+	client.CloseWrite()
+	got, err := io.ReadAll(client)
+	if err != nil || !bytes.Equal(got, resp) {
+		t.Fatalf("client read %d bytes, %v", len(got), err)
+	}
+	s := <-done
+	if s.up != int64(len(req)) || s.down != int64(len(resp)) {
+		t.Fatalf("%d bytes up and %d down, want %d and %d", s.up, s.down, len(req), len(resp))
+	}
+	if s.reason != "closed by client" {
+		t.Fatalf("reason %q", s.reason)
+	}
+}
+
+// answerAfterEOF starts a target answering resp once its client half-closed.
+func answerAfterEOF(t *testing.T, resp []byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(io.Discard, c)
+				c.Write(resp)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// aeadClient is the client end of a shadowsocks stream. Unlike a client in
+// this process, it leaves the salts out of the replay check.
+type aeadClient struct {
+	net.Conn
+	ciph shadowaead.Cipher
+	r    io.Reader
+	w    io.Writer
+}
+
+func newAEADClient(t *testing.T, c net.Conn, ciph core.Cipher) *aeadClient {
+	sc := ciph.(shadowaead.Cipher)
+	salt := make([]byte, sc.SaltSize())
+	rand.Read(salt)
+	aead, err := sc.Encrypter(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(salt); err != nil {
+		t.Fatal(err)
+	}
+	return &aeadClient{Conn: c, ciph: sc, w: shadowaead.NewWriter(c, aead)}
+}
+
+func (c *aeadClient) Read(b []byte) (int, error) {
+	if c.r == nil {
+		salt := make([]byte, c.ciph.SaltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.ciph.Decrypter(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.r = shadowaead.NewReader(c.Conn, aead)
+	}
+	return c.r.Read(b)
+}
+
+func (c *aeadClient) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *aeadClient) CloseWrite() error           { return closeWrite(c.Conn) }
+
+func TestRelayHalfCloseWS(t *testing.T) {
+	users := testUsers(t)
+	l, err := transport.Listen("ws://127.0.0.1:0/p", users.keys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(c, users)
+		}
+	}()
+	resp := bytes.Repeat([]byte("r"), 3000)
+	tgt := answerAfterEOF(t, resp)
+
+	d, err := transport.NewDialer("ws://dk@" + l.Addr().String() + "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial(transport.ModeStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rc := newAEADClient(t, conn, users.byName[""].ciph)
+	if _, err := rc.Write(socks.ParseAddr(tgt)); err != nil {
+		t.Fatal(err)
+	}
+	client, clientLeg := tcpPair(t)
+	go relay(clientLeg, rc)
+
+	client.Write([]byte("request"))
+	client.CloseWrite()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil || !bytes.Equal(got, resp) {
+		t.Fatalf("client read %d bytes, %v", len(got), err)
+	}
+}
+
+func TestRelayCloseWriteUnsupported(t *testing.T) {
+	if err := newEarlyConn(nil).CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("CloseWrite before dialing: %v", err)
+	}
+
+	client, clientLeg := tcpPair(t)
+	targetLeg, target := net.Pipe() // cannot half-close
+	defer target.Close()
+	go io.Copy(io.Discard, target)
+	done := make(chan relaySummary, 1)
+	go func() { done <- relay(clientLeg, targetLeg) }()
+
+	// instead of hanging, the relay ends in both directions
+	client.Write([]byte("request"))
+	client.CloseWrite()
+	select {
+	case s := <-done:
+		if s.reason != "closed by client" {
+			t.Fatalf("reason %q", s.reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay still running")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/BigSully/shadowsocks-ws/mux"
+	"github.com/BigSully/shadowsocks-ws/transport"
+)
+
+// muxClient spreads streams over a few long-lived multiplexed connections.
+type muxClient struct {
+	dial func() (net.Conn, error)
+	size int
+
+	mu       sync.Mutex
+	sessions []*muxSession
+	dialing  int        // dials in progress
+	dialed   *sync.Cond // signaled when a dial ends
+}
+
+// muxSession is a multiplexed connection of a muxClient.
+type muxSession struct {
+	*mux.Session
+	compressed bool // the ends agreed to compress the streams
+}
+
+// newMuxClient returns a muxClient using up to size connections from dial.
+func newMuxClient(size int, dial func() (net.Conn, error)) *muxClient {
+	m := &muxClient{dial: dial, size: size}
+	m.dialed = sync.NewCond(&m.mu)
+	return m
+}
+
+// Open opens a stream on the least busy connection, dialing a new one while
+// there are fewer than m.size. Streams go to the live connections while a
+// dial is in progress or when it fails.
+func (m *muxClient) Open() (net.Conn, error) {
+	m.mu.Lock()
+	for {
+		m.prune()
+		if len(m.sessions)+m.dialing < m.size {
+			break
+		}
+		if len(m.sessions) > 0 {
+			s := m.leastBusy()
+			m.mu.Unlock()
+			return open(s)
+		}
+		m.dialed.Wait() // nothing to use until a dial ends
+	}
+	m.dialing++
+	m.mu.Unlock()
+
+	c, err := m.dial()
+
+	m.mu.Lock()
+	m.dialing--
+	m.dialed.Broadcast()
+	if err == nil {
+		s := &muxSession{mux.Client(c), transport.Compressed(c)}
+		m.sessions = append(m.sessions, s)
+		m.mu.Unlock()
+		return open(s)
+	}
+	m.prune()
+	if len(m.sessions) == 0 {
+		m.mu.Unlock()
+		return nil, err
+	}
+	s := m.leastBusy()
+	m.mu.Unlock()
+	return open(s)
+}
+
+// prune drops the closed connections. m.mu must be held.
+func (m *muxClient) prune() {
+	live := m.sessions[:0]
+	for _, s := range m.sessions {
+		if !s.IsClosed() {
+			live = append(live, s)
+		}
+	}
+	for i := len(live); i < len(m.sessions); i++ {
+		m.sessions[i] = nil
+	}
+	m.sessions = live
+}
+
+// leastBusy returns the connection with the fewest streams. m.mu must be
+// held and there must be a connection.
+func (m *muxClient) leastBusy() *muxSession {
+	best := m.sessions[0]
+	for _, s := range m.sessions[1:] {
+		if s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	return best
+}
+
+// open opens a stream on s, compressed if the ends of s agreed to.
+func open(s *muxSession) (net.Conn, error) {
+	st, err := s.Open()
+	if err != nil {
+		return nil, err
+	}
+	if s.compressed {
+		return newCompressConn(st), nil
+	}
+	return st, nil
+}
+
+// serveMux proxies every stream opened on the multiplexed connection c of usr.
+func serveMux(c net.Conn, remoteAddr string, usr *user) {
+	compressed := transport.Compressed(c)
+	sess := mux.Server(c)
+	defer sess.Close()
+
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			var c net.Conn = st
+			if compressed {
+				c = newCompressConn(st)
+			}
+			handleTCP(c, remoteAddr, usr)
+		}()
+	}
+}
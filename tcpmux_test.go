@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/mux"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// muxPeer returns the client end of a connection to a mux server accepting
+// every stream.
+func muxPeer(t *testing.T) net.Conn {
+	c, s := net.Pipe()
+	srv := mux.Server(s)
+	t.Cleanup(func() { srv.Close() })
+	go func() {
+		for {
+			if _, err := srv.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func TestMuxClientSlowDial(t *testing.T) {
+	release := make(chan error)
+	dials := 0
+	m := newMuxClient(2, func() (net.Conn, error) {
+		dials++
+		if dials == 1 {
+			return muxPeer(t), nil
+		}
+		return nil, <-release // hangs until released, then fails
+	})
+
+	if _, err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	slow := make(chan error, 1)
+	go func() {
+		_, err := m.Open() // dials the second connection
+		slow <- err
+	}()
+	for {
+		m.mu.Lock()
+		dialing := m.dialing
+		m.mu.Unlock()
+		if dialing == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the hanging dial does not hold up streams on the live connection
+	opened := make(chan error, 1)
+	go func() {
+		_, err := m.Open()
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Open waited for another dial")
+	}
+
+	// the failed dial falls back to the live connection
+	release <- errors.New("dial failed")
+	if err := <-slow; err != nil {
+		t.Fatalf("Open failed with a live connection: %v", err)
+	}
+}
+
+func TestMuxClientDialError(t *testing.T) {
+	m := newMuxClient(2, func() (net.Conn, error) { return nil, errors.New("dial failed") })
+	if c, err := m.Open(); err == nil || c != nil {
+		t.Fatalf("got %v, %v without a connection", c, err)
+	}
+}
+
+func TestMuxCompressSkip(t *testing.T) {
+	config.Compress, config.CompressLevel = true, 1
+	defer func() { config.Compress, config.CompressLevel, config.CompressSkip = false, 0, nil }()
+	users := testUsers(t)
+
+	// targets sending what they read back
+	target := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer c.Close()
+					io.Copy(c, c)
+				}()
+			}
+		}()
+		return l.Addr().String()
+	}
+	plain, compressed := target(), target()
+	_, port, _ := net.SplitHostPort(plain)
+	config.CompressSkip = parsePorts(port)
+
+	c, s := net.Pipe()
+	go serveMux(compressedCarrier{s}, "test", users.byName[""])
+	t.Cleanup(func() { c.Close() })
+	m := newMuxClient(1, func() (net.Conn, error) { return compressedCarrier{c}, nil })
+
+	for _, tc := range []struct {
+		target string
+		flag   byte
+	}{
+		{compressed, flagDeflate},
+		{plain, flagPlain},
+	} {
+		st, err := m.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tgt := socks.ParseAddr(tc.target)
+		compressFor(st, tgt)
+		st.Write(tgt)
+		st.Write([]byte("hello"))
+
+		// each end compresses a stream unless its target is skipped
+		raw := st.(*compressConn).Conn
+		raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+		flag := make([]byte, 1)
+		if _, err := io.ReadFull(raw, flag); err != nil || flag[0] != tc.flag {
+			t.Fatalf("%s: server sent flag %d, %v, want %d", tc.target, flag[0], err, tc.flag)
+		}
+		if st.(*compressConn).plain != (tc.flag == flagPlain) {
+			t.Fatalf("%s: client compressing %v", tc.target, !st.(*compressConn).plain)
+		}
+		st.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// Supports reports whether a server offering modes besides ModeStream
+// accepts connections in mode.
+func Supports(modes []string, mode string) bool {
+	if mode == ModeStream {
+		return true
+	}
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepted returns c, accepted from the client at clientAddr for user in
+// mode, as a connection reporting them to User, Mode and ClientAddr. It
+// implements net.PacketConn if c does.
+func Accepted(c net.Conn, user, mode, clientAddr string) net.Conn {
+	a := &accepted{c, user, mode, clientAddr}
+	if pc, ok := c.(net.PacketConn); ok {
+		return &acceptedPacket{a, pc}
+	}
+	return a
+}
+
+type accepted struct {
+	net.Conn
+	user, mode, clientAddr string
+}
+
+func (c *accepted) User() string       { return c.user }
+func (c *accepted) Mode() string       { return c.mode }
+func (c *accepted) ClientAddr() string { return c.clientAddr }
+
+func (c *accepted) Compressed() bool { return Compressed(c.Conn) }
+
+// CloseWrite closes the writing side of the connection if it supports that.
+func (c *accepted) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+type acceptedPacket struct {
+	*accepted
+	pc net.PacketConn
+}
+
+func (c *acceptedPacket) ReadFrom(b []byte) (int, net.Addr, error) { return c.pc.ReadFrom(b) }
+func (c *acceptedPacket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
+
+// Queue hands the connections of a server calling a handler for each to
+// the Accept method of a Listener.
+type Queue struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+// NewQueue returns an empty Queue.
+func NewQueue() *Queue {
+	return &Queue{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Put waits for Accept to take c, or closes c once the queue is stopped.
+func (q *Queue) Put(c net.Conn) {
+	select {
+	case q.conns <- c:
+	case <-q.done:
+		c.Close()
+	}
+}
+
+// Stop makes Accept fail with err from now on. Only the first call counts.
+func (q *Queue) Stop(err error) {
+	q.once.Do(func() {
+		q.err = err
+		close(q.done)
+	})
+}
+
+// Accept returns the next connection put in the queue.
+func (q *Queue) Accept() (net.Conn, error) {
+	select {
+	case c := <-q.conns:
+		return c, nil
+	case <-q.done:
+		return nil, q.err
+	}
+}
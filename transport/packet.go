@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// ErrPacketTooLarge is returned when writing a packet of more than 64 KiB.
+var ErrPacketTooLarge = errors.New("transport: packet too large")
+
+// PacketConn carries packets over a stream connection, each prefixed with
+// its length as a big-endian uint16, for transports without packets of
+// their own.
+type PacketConn struct {
+	net.Conn
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// NewPacketConn returns a net.PacketConn sending and receiving packets over
+// the stream of c. Packets are read from and written to the peer of c
+// whatever the address.
+func NewPacketConn(c net.Conn) *PacketConn { return &PacketConn{c} }
+
+// ReadFrom reads the next packet into b. The part of the packet that does
+// not fit into b is discarded.
+func (pc *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := ReadPacket(pc.Conn, b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, pc.RemoteAddr(), nil
+}
+
+// WriteTo sends b as one packet to the peer of the connection.
+func (pc *PacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if err := WritePacket(pc.Conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadPacket reads the next length-prefixed packet from r into b. The part
+// of the packet that does not fit into b is discarded. It returns io.EOF
+// only if r ends before the packet starts.
+func ReadPacket(r io.Reader, b []byte) (int, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(hdr[:]))
+	n := size
+	if n > len(b) {
+		n = len(b)
+	}
+	if _, err := io.ReadFull(r, b[:n]); err != nil {
+		return 0, unexpected(err)
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(size-n)); err != nil {
+		return 0, unexpected(err)
+	}
+	return n, nil
+}
+
+// WritePacket writes b to w prefixed with its length, in a single Write.
+func WritePacket(w io.Writer, b []byte) error {
+	if len(b) > 0xffff {
+		return ErrPacketTooLarge
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// unexpected turns the end of the stream within a packet into an error.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
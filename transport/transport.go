@@ -0,0 +1,159 @@
+// Package transport abstracts how encrypted connections reach the server.
+//
+// A transport is chosen by the scheme of the server URL, such as ws or wss.
+// Its Dialer opens connections on the client and its Listener accepts them
+// on the server. Each connection carries what its mode says: one proxied
+// stream, many multiplexed streams, or UDP packets.
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Modes of connections, chosen by the client when dialing.
+const (
+	ModeStream = ""    // one proxied TCP connection
+	ModeMux    = "mux" // multiplexed TCP connections
+	ModePacket = "udp" // UDP packets, one per Read or Write
+)
+
+// ErrClosed is returned by Accept once a listener is closed.
+var ErrClosed = errors.New("transport: listener closed")
+
+// Dialer connects to a server. Connections dialed in ModePacket implement
+// net.PacketConn as well, whose ReadFrom and WriteTo keep packet boundaries.
+type Dialer interface {
+	Dial(mode string) (net.Conn, error)
+}
+
+// EarlyDialer is a Dialer able to send the first bytes of a connection
+// along with its setup, saving a round trip.
+type EarlyDialer interface {
+	Dialer
+	DialEarly(mode string, early []byte) (net.Conn, error)
+}
+
+// Listener accepts connections of clients. Connections accepted in
+// ModePacket implement net.PacketConn as well, like those dialed.
+type Listener interface {
+	Accept() (net.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// Shutdowner is a Listener able to stop gracefully, waiting for accepted
+// connections to be closed until ctx is done.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// DialerFunc returns a Dialer for the server at u.
+type DialerFunc func(u *url.URL) (Dialer, error)
+
+// ListenerFunc returns a Listener at u accepting clients with the keys of
+// users, which maps keys to user names. No keys accepts every client.
+type ListenerFunc func(u *url.URL, users map[string]string) (Listener, error)
+
+var (
+	mu        sync.RWMutex
+	dialers   = make(map[string]DialerFunc)
+	listeners = make(map[string]ListenerFunc)
+)
+
+// Register makes the transport of scheme available to NewDialer and Listen.
+func Register(scheme string, dial DialerFunc, listen ListenerFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+	dialers[scheme] = dial
+	listeners[scheme] = listen
+}
+
+func parse(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(strings.Trim(rawurl, "'"))
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Supported reports whether rawurl is the URL of a registered transport.
+func Supported(rawurl string) bool {
+	u, err := parse(rawurl)
+	if err != nil {
+		return false
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	_, ok := dialers[u.Scheme]
+	return ok
+}
+
+// NewDialer returns a Dialer for the server at rawurl.
+func NewDialer(rawurl string) (Dialer, error) {
+	u, err := parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	mu.RLock()
+	f := dialers[u.Scheme]
+	mu.RUnlock()
+	if f == nil {
+		return nil, fmt.Errorf("transport: unsupported scheme %q", u.Scheme)
+	}
+	return f(u)
+}
+
+// Listen returns a Listener at rawurl accepting clients with the keys of
+// users.
+func Listen(rawurl string, users map[string]string) (Listener, error) {
+	u, err := parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	mu.RLock()
+	f := listeners[u.Scheme]
+	mu.RUnlock()
+	if f == nil {
+		return nil, fmt.Errorf("transport: unsupported scheme %q", u.Scheme)
+	}
+	return f(u, users)
+}
+
+// User returns the name of the user who opened the accepted connection c,
+// or "" if unknown.
+func User(c net.Conn) string {
+	if u, ok := c.(interface{ User() string }); ok {
+		return u.User()
+	}
+	return ""
+}
+
+// Mode returns the mode the client chose for c.
+func Mode(c net.Conn) string {
+	if m, ok := c.(interface{ Mode() string }); ok {
+		return m.Mode()
+	}
+	return ModeStream
+}
+
+// Compressed reports whether both ends of c agreed to compress the stream
+// it carries.
+func Compressed(c net.Conn) bool {
+	cc, ok := c.(interface{ Compressed() bool })
+	return ok && cc.Compressed()
+}
+
+// ClientAddr returns the address of the client of the accepted connection
+// c, which differs from its remote address behind proxies.
+func ClientAddr(c net.Conn) string {
+	if a, ok := c.(interface{ ClientAddr() string }); ok {
+		return a.ClientAddr()
+	}
+	return c.RemoteAddr().String()
+}
@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+)
+
+type pipeDialer struct{ scheme string }
+
+func (d pipeDialer) Dial(mode string) (net.Conn, error) {
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+type userConn struct {
+	net.Conn
+}
+
+func (userConn) User() string       { return "alice" }
+func (userConn) Mode() string       { return ModeMux }
+func (userConn) ClientAddr() string { return "192.0.2.1" }
+func (userConn) Compressed() bool   { return true }
+
+func TestRegistry(t *testing.T) {
+	Register("pipe", func(u *url.URL) (Dialer, error) { return pipeDialer{u.Scheme}, nil }, nil)
+
+	if !Supported("pipe://host") || Supported("nope://host") || Supported("host:port") {
+		t.Fatal("wrong schemes supported")
+	}
+	d, err := NewDialer("'pipe://key@host/path'")
+	if err != nil || d.(pipeDialer).scheme != "pipe" {
+		t.Fatalf("got dialer %v, %v", d, err)
+	}
+	if _, err := NewDialer("nope://host"); err == nil {
+		t.Fatal("dialer for unknown scheme")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	if User(a) != "" || Mode(a) != ModeStream || ClientAddr(a) != a.RemoteAddr().String() || Compressed(a) {
+		t.Fatal("wrong defaults for a plain connection")
+	}
+	c := userConn{a}
+	if User(c) != "alice" || Mode(c) != ModeMux || ClientAddr(c) != "192.0.2.1" || !Compressed(c) {
+		t.Fatal("metadata of the connection ignored")
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	pa, pb := NewPacketConn(a), NewPacketConn(b)
+
+	go func() {
+		for _, msg := range []string{"first", "", "third"} {
+			pa.WriteTo([]byte(msg), nil)
+		}
+		a.Write([]byte{0, 9, 'c', 'u', 't'}) // the stream ends within a packet
+		a.Close()
+	}()
+	for _, want := range []string{"first", "", "thi"} {
+		buf := make([]byte, len(want)) // the rest of "third" is discarded
+		n, _, err := pb.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("read %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+	if _, _, err := pb.ReadFrom(make([]byte, 100)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated packet read %v", err)
+	}
+	if _, err := pb.WriteTo(make([]byte, 0x10000), nil); err != ErrPacketTooLarge {
+		t.Fatalf("wrote a packet too large: %v", err)
+	}
+}
+
+func TestSupports(t *testing.T) {
+	modes := []string{ModeMux}
+	if !Supports(nil, ModeStream) || !Supports(modes, ModeMux) || Supports(modes, ModePacket) {
+		t.Fatal("wrong modes supported")
+	}
+}
+
+func TestAccepted(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	c := Accepted(a, "alice", ModeMux, "192.0.2.1")
+	if User(c) != "alice" || Mode(c) != ModeMux || ClientAddr(c) != "192.0.2.1" {
+		t.Fatal("metadata of the connection ignored")
+	}
+	if _, ok := c.(net.PacketConn); ok {
+		t.Fatal("stream accepted as a packet connection")
+	}
+	if Compressed(c) || !Compressed(Accepted(userConn{a}, "alice", ModeMux, "")) {
+		t.Fatal("compression of the connection ignored")
+	}
+	if err := c.(interface{ CloseWrite() error }).CloseWrite(); err != errors.ErrUnsupported {
+		t.Fatalf("CloseWrite of a pipe: %v", err)
+	}
+
+	pc := Accepted(NewPacketConn(a), "alice", ModePacket, "192.0.2.1")
+	go pc.(net.PacketConn).WriteTo([]byte("packet"), nil)
+	buf := make([]byte, 100)
+	n, _, err := NewPacketConn(b).ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "packet" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	q := NewQueue()
+	a, b := net.Pipe()
+	defer b.Close()
+	go q.Put(a)
+	if c, err := q.Accept(); c != a || err != nil {
+		t.Fatalf("accepted %v, %v", c, err)
+	}
+
+	q.Stop(ErrClosed)
+	q.Stop(io.EOF)
+	if _, err := q.Accept(); err != ErrClosed {
+		t.Fatalf("accept after Stop: %v", err)
+	}
+	q.Put(a) // closes a instead of blocking
+	if _, err := b.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("write to a connection put after Stop: %v", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"sync"
 
+	"github.com/BigSully/shadowsocks-ws/transport"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
@@ -20,9 +21,34 @@ const (
 
 const udpBufSize = 64 * 1024
 
+// udpServer returns the address of server and a function creating sockets
+// to send packets there: UDP sockets for a plain server, and transport
+// connections in packet mode for a server URL, whose address is then nil.
+func udpServer(server string) (net.Addr, func() (net.PacketConn, error), error) {
+	if !transport.Supported(server) {
+		srvAddr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			return nil, nil, err
+		}
+		return srvAddr, func() (net.PacketConn, error) { return net.ListenPacket("udp", "") }, nil
+	}
+
+	d, err := transport.NewDialer(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, func() (net.PacketConn, error) {
+		conn, err := d.Dial(transport.ModePacket)
+		if err != nil {
+			return nil, err
+		}
+		return conn.(net.PacketConn), nil
+	}, nil
+}
+
 // Listen on laddr for UDP packets, encrypt and send to server to reach target.
 func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.PacketConn) {
-	srvAddr, err := net.ResolveUDPAddr("udp", server)
+	srvAddr, listen, err := udpServer(server)
 	if err != nil {
 		logf("UDP server address error: %v", err)
 		return
@@ -56,7 +82,7 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 
 		pc := nm.Get(raddr.String())
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = listen()
 			if err != nil {
 				logf("UDP local listen error: %v", err)
 				continue
@@ -76,7 +102,7 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 
 // Listen on laddr for Socks5 UDP packets, encrypt and send to server to reach target.
 func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketConn) {
-	srvAddr, err := net.ResolveUDPAddr("udp", server)
+	srvAddr, listen, err := udpServer(server)
 	if err != nil {
 		logf("UDP server address error: %v", err)
 		return
@@ -101,7 +127,7 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 
 		pc := nm.Get(raddr.String())
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = listen()
 			if err != nil {
 				logf("UDP local listen error: %v", err)
 				continue
@@ -119,58 +145,123 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 	}
 }
 
-// Listen on addr for encrypted packets and basically do UDP NAT.
-func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
+// Listen on addr for encrypted packets of users and basically do UDP NAT.
+func udpRemote(addr string, users *userTable) {
 	c, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		logf("UDP remote listen error: %v", err)
 		return
 	}
 	defer c.Close()
-	c = shadow(c)
 
 	nm := newNATmap(config.UDPTimeout)
+	pkt := make([]byte, udpBufSize)
 	buf := make([]byte, udpBufSize)
 
 	logf("listening UDP on %s", addr)
 	for {
-		n, raddr, err := c.ReadFrom(buf)
+		n, raddr, err := c.ReadFrom(pkt)
 		if err != nil {
 			logf("UDP remote read error: %v", err)
 			continue
 		}
 
-		tgtAddr := socks.SplitAddr(buf[:n])
-		if tgtAddr == nil {
-			logf("failed to split target address from packet: %q", buf[:n])
+		usr, b, err := users.unpack(buf, pkt[:n])
+		if err != nil {
+			logf("UDP remote read error: %v", err)
 			continue
 		}
 
-		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
+		udpForward(nm, c, raddr, b, usr)
+	}
+}
+
+// serveUDP does UDP NAT for the packets of usr carried by the transport
+// connection pc until pc fails. Packets failing to decrypt are dropped.
+func serveUDP(pc net.PacketConn, usr *user) {
+	nm := newNATmap(config.UDPTimeout)
+	pkt := make([]byte, udpBufSize)
+	buf := make([]byte, udpBufSize)
+
+	peers := make(map[string]bool)
+	for {
+		n, raddr, err := pc.ReadFrom(pkt)
 		if err != nil {
-			logf("failed to resolve target UDP address: %v", err)
+			for peer := range peers {
+				if pc := nm.Del(peer); pc != nil {
+					pc.Close()
+				}
+			}
+			return
+		}
+
+		b, err := usr.unpack(buf, pkt[:n])
+		if err != nil {
+			logf("UDP remote read error: %v", err)
 			continue
 		}
+		peers[raddr.String()] = true
+		udpForward(nm, pc, raddr, b, usr)
+	}
+}
 
-		payload := buf[len(tgtAddr):n]
+// udpForward sends the decrypted packet b from raddr of usr to its target,
+// relaying the replies encrypted back to raddr through c.
+func udpForward(nm *natmap, c net.PacketConn, raddr net.Addr, b []byte, usr *user) {
+	tgtAddr := socks.SplitAddr(b)
+	if tgtAddr == nil {
+		logf("failed to split target address from packet: %q", b)
+		return
+	}
 
-		pc := nm.Get(raddr.String())
-		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
-			if err != nil {
-				logf("UDP remote listen error: %v", err)
-				continue
-			}
+	tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
+	if err != nil {
+		logf("failed to resolve target UDP address: %v", err)
+		return
+	}
 
-			nm.Add(raddr, c, pc, remoteServer)
-		}
+	payload := b[len(tgtAddr):]
 
-		_, err = pc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
+	pc := nm.Get(raddr.String())
+	if pc == nil {
+		pc, err = net.ListenPacket("udp", "")
 		if err != nil {
-			logf("UDP remote write error: %v", err)
-			continue
+			logf("UDP remote listen error: %v", err)
+			return
 		}
+
+		logf("UDP %s <-> %s (user %s)", raddr, tgtAddr, usr)
+		pc = &userPacketConn{pc, usr}
+		nm.Add(raddr, usr.ciph.PacketConn(c), pc, remoteServer)
+	}
+
+	_, err = pc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
+	if err != nil {
+		logf("UDP remote write error: %v", err)
+	}
+}
+
+// userPacketConn is a socket to the targets of usr adding the payload bytes
+// it sends and receives to the totals of usr.
+type userPacketConn struct {
+	net.PacketConn
+	usr *user
+}
+
+func (c *userPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if n > 0 {
+		c.usr.count(0, int64(n))
+	}
+	return n, addr, err
+}
+
+func (c *userPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if n > 0 {
+		c.usr.count(int64(n), 0)
 	}
+	return n, err
 }
 
 // Packet NAT table
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// sealPacket returns the packet of a client of ciph sending payload. Like
+// seal, it leaves the salt out of the replay check.
+func sealPacket(t *testing.T, ciph core.Cipher, payload []byte) []byte {
+	t.Helper()
+	sc := ciph.(shadowaead.Cipher)
+	salt := make([]byte, sc.SaltSize())
+	rand.Read(salt)
+	aead, err := sc.Encrypter(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead.Seal(salt, make([]byte, aead.NonceSize()), payload, nil)
+}
+
+// openPacket decrypts the packet pkt of a server of ciph, which put its salt
+// in the replay filter of this process.
+func openPacket(t *testing.T, ciph core.Cipher, pkt []byte) []byte {
+	t.Helper()
+	sc := ciph.(shadowaead.Cipher)
+	aead, err := sc.Decrypter(pkt[:sc.SaltSize()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := aead.Open(nil, make([]byte, aead.NonceSize()), pkt[sc.SaltSize():], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestServeUDP(t *testing.T) {
+	config.UDPTimeout = time.Minute
+	defer func() { config.UDPTimeout = 0 }()
+	usr := testUsers(t).byName["alice"]
+
+	// the target echoes packets and reports their sources
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	sources := make(chan string, 4)
+	go func() {
+		b := make([]byte, udpBufSize)
+		for {
+			n, addr, err := target.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			sources <- addr.String()
+			target.WriteTo(b[:n], addr)
+		}
+	}()
+
+	a, b := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		serveUDP(transport.NewPacketConn(a), usr)
+		close(done)
+	}()
+	client := transport.NewPacketConn(b)
+	tgt := socks.ParseAddr(target.LocalAddr().String())
+
+	reply := func(msg string) string {
+		t.Helper()
+		b.SetDeadline(time.Now().Add(5 * time.Second))
+		pkt := make([]byte, udpBufSize)
+		n, _, err := client.ReadFrom(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := openPacket(t, usr.ciph, pkt[:n])
+		if !bytes.Equal(reply, append(tgt, msg...)) {
+			t.Fatalf("reply %q to %q", reply, msg)
+		}
+		return <-sources
+	}
+	send := func(msg string) []byte {
+		b.SetDeadline(time.Now().Add(5 * time.Second))
+		pkt := sealPacket(t, usr.ciph, append(tgt, msg...))
+		client.WriteTo(pkt, nil)
+		return pkt
+	}
+
+	send("one")
+	first := reply("one")
+
+	// bad packets are dropped without ending the session
+	client.WriteTo([]byte("not a packet"), nil)
+	client.WriteTo(sealPacket(t, testUsers(t).byName["bob"].ciph, append(tgt, "bob"...)), nil)
+	replayed := send("replayed")
+	client.WriteTo(replayed, nil)
+	reply("replayed")
+	send("two")
+	if src := reply("two"); src != first {
+		t.Fatalf("second packet sent from %s, first from %s", src, first)
+	}
+
+	b.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not ended with its connection")
+	}
+}
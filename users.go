@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// A user of the server with its own credentials and traffic counters.
+type user struct {
+	Name      string `json:"name"`
+	Key       string `json:"key"`        // client key sent in the WebSocket handshake
+	Cipher    string `json:"cipher"`     // defaults to the -cipher flag
+	CipherKey string `json:"cipher_key"` // base64url-encoded, derived from Password if empty
+	Password  string `json:"password"`
+
+	ciph     core.Cipher
+	up, down int64 // bytes relayed since start, accessed atomically
+}
+
+func (u *user) String() string {
+	if u.Name == "" {
+		return "-"
+	}
+	return u.Name
+}
+
+// count adds relayed bytes, of a TCP relay or of UDP packets, to the user's
+// totals and returns the new totals.
+func (u *user) count(up, down int64) (int64, int64) {
+	return atomic.AddInt64(&u.up, up), atomic.AddInt64(&u.down, down)
+}
+
+// userTable holds the users a server accepts.
+type userTable struct {
+	list        []*user
+	byName      map[string]*user
+	defaultKeys []string // client keys of the default user
+}
+
+// loadUsers builds the user table of a server. The default user has no name
+// and uses ciph. It accepts the given keys, or everybody if there are no keys
+// and no users file. The users file is a JSON array of users.
+func loadUsers(path string, ciph core.Cipher, cipher string, keys []string) (*userTable, error) {
+	t := &userTable{byName: make(map[string]*user), defaultKeys: keys}
+
+	if path == "" || len(keys) > 0 {
+		def := &user{ciph: ciph}
+		t.list = append(t.list, def)
+		t.byName[def.Name] = def
+	}
+
+	if path == "" {
+		return t, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users []*user
+	if err := json.Unmarshal(b, &users); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, u := range users {
+		if u.Name == "" || u.Key == "" {
+			return nil, fmt.Errorf("%s: user needs a name and a key", path)
+		}
+		if _, ok := t.byName[u.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate user %q", path, u.Name)
+		}
+		if u.Cipher == "" {
+			u.Cipher = cipher
+		}
+		var key []byte
+		if u.CipherKey != "" {
+			if key, err = base64.URLEncoding.DecodeString(u.CipherKey); err != nil {
+				return nil, fmt.Errorf("%s: user %s: %v", path, u.Name, err)
+			}
+		}
+		if u.ciph, err = core.PickCipher(u.Cipher, key, u.Password); err != nil {
+			return nil, fmt.Errorf("%s: user %s: %v", path, u.Name, err)
+		}
+		t.list = append(t.list, u)
+		t.byName[u.Name] = u
+	}
+	return t, nil
+}
+
+// keys maps the client keys accepted by the WebSocket server to user names.
+// An empty map means anybody is accepted as the default user.
+func (t *userTable) keys() map[string]string {
+	m := make(map[string]string)
+	for _, k := range t.defaultKeys {
+		m[k] = ""
+	}
+	for _, u := range t.list {
+		if u.Key != "" {
+			m[u.Key] = u.Name
+		}
+	}
+	return m
+}
+
+// unpack decrypts an UDP packet with the cipher of each user in turn and
+// returns the first user whose cipher authenticates it.
+func (t *userTable) unpack(dst, pkt []byte) (*user, []byte, error) {
+	err := fmt.Errorf("no user can decrypt packet")
+	for _, u := range t.list {
+		var b []byte
+		if b, err = u.unpack(dst, pkt); err == nil {
+			return u, b, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// unpack decrypts the packet pkt of u into dst and returns the plaintext.
+func (u *user) unpack(dst, pkt []byte) ([]byte, error) {
+	ciph, ok := u.ciph.(shadowaead.Cipher)
+	if !ok { // plaintext cipher
+		return pkt, nil
+	}
+	return shadowaead.Unpack(dst, pkt, ciph)
+}
+
+// identifyHeader is enough of a stream to identify its user: the longest
+// salt and the sealed length of the first chunk.
+const identifyHeader = 32 + 2 + 16
+
+// identify returns the user whose cipher decrypts the first chunk of the
+// stream starting with hdr, or nil if there is none. A user with the dummy
+// cipher matches any stream. The salt is not recorded, so the replay check
+// of the stream still sees it.
+func (t *userTable) identify(hdr []byte) *user {
+	for _, u := range t.list {
+		ciph, ok := u.ciph.(shadowaead.Cipher)
+		if !ok { // plaintext cipher
+			return u
+		}
+		n := ciph.SaltSize()
+		if len(hdr) < n+2+16 {
+			continue
+		}
+		aead, err := ciph.Decrypter(hdr[:n])
+		if err != nil {
+			continue
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := aead.Open(nil, nonce, hdr[n:n+2+aead.Overhead()], nil); err == nil {
+			return u
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package ws
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Time allowed for the close message to reach the peer before the
+// connection is torn down.
+const closeWait = time.Second
+
+// Conn is a net.Conn carrying a byte stream over a WebSocket connection.
+// Writes are sent as binary messages and reads consume incoming messages
+// back to back, so message boundaries are invisible to the caller. A text
+// message ends the stream of its sender, see CloseWrite.
+type Conn struct {
+	active  int64 // UnixNano of the last message read or written, accessed atomically
+	seen    int64 // UnixNano of the last frame read, accessed atomically
+	waiting int64 // UnixNano since when a reader waits for frames, 0 if none, accessed atomically
+
+	conn *websocket.Conn
+	user string
+
+	rmu   sync.Mutex // serializes readers
+	r     io.Reader  // reader of the message being consumed by Read
+	early []byte     // early data of the upgrade request not read yet
+	eof   bool       // the peer closed its side
+
+	halfClose  bool // both ends negotiated CloseWrite
+	compressed bool // both ends negotiated compression of the stream
+
+	wmu     sync.Mutex // serializes writers
+	wclosed bool       // CloseWrite was called, guarded by wmu
+
+	closeOnce sync.Once
+	closeErr  error
+	onClose   func()        // called once closed, if not nil
+	done      chan struct{} // closed by Close
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func newConn(c *websocket.Conn) *Conn {
+	now := time.Now().UnixNano()
+	conn := &Conn{
+		conn:   c,
+		active: now,
+		seen:   now,
+		done:   make(chan struct{}),
+	}
+	c.SetPongHandler(func(string) error {
+		conn.saw()
+		return nil
+	})
+	return conn
+}
+
+// Read reads the payload of incoming messages as one continuous stream, moving
+// on to the next message once the current one is exhausted. A close message
+// from the peer ends the stream with io.EOF. Early data sent with the upgrade
+// request comes first.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if len(c.early) > 0 {
+		n = copy(p, c.early)
+		c.early = c.early[n:]
+		return n, nil
+	}
+
+	atomic.StoreInt64(&c.waiting, time.Now().UnixNano())
+	defer atomic.StoreInt64(&c.waiting, 0)
+	for {
+		if c.r == nil {
+			if err = c.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err = c.r.Read(p)
+		if n > 0 {
+			c.saw()
+		}
+		if err == io.EOF { // end of message, not of stream
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return
+	}
+}
+
+// next waits for the next message and makes it the one Read consumes.
+// c.rmu must be held.
+func (c *Conn) next() error {
+	if c.eof {
+		return io.EOF
+	}
+	typ, r, err := c.conn.NextReader()
+	if err != nil {
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			err = io.EOF
+		}
+		return err
+	}
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	c.saw()
+	if typ == websocket.TextMessage { // the peer called CloseWrite
+		c.eof = true
+		go c.drain()
+		return io.EOF
+	}
+	c.r = r
+	return nil
+}
+
+// drain goes on reading after the peer closed its side, which lets pongs
+// and the close message of the peer through.
+func (c *Conn) drain() {
+	atomic.StoreInt64(&c.waiting, time.Now().UnixNano())
+	for {
+		if _, _, err := c.conn.NextReader(); err != nil {
+			return
+		}
+		c.saw()
+	}
+}
+
+// saw records that a frame from the peer was read.
+func (c *Conn) saw() { atomic.StoreInt64(&c.seen, time.Now().UnixNano()) }
+
+// Write sends p as a single binary message.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.wclosed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	return len(p), nil
+}
+
+// CloseWrite tells the peer that no more data will be written, while data
+// from the peer can still be read. It sends an empty text message, upon
+// which Read of the peer returns io.EOF. Peers not knowing about it would
+// wait for more, so CloseWrite fails with errors.ErrUnsupported unless
+// both ends sent HalfCloseHeader during the handshake.
+func (c *Conn) CloseWrite() error {
+	if !c.halfClose {
+		return errors.ErrUnsupported
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.wclosed {
+		return nil
+	}
+	c.wclosed = true
+	return c.conn.WriteMessage(websocket.TextMessage, nil)
+}
+
+// Close sends a close message to the peer and closes the underlying
+// connection. It is safe to call Close more than once.
+func (c *Conn) Close() error {
+	return c.closeWith(websocket.CloseNormalClosure)
+}
+
+// closeWith closes the connection with the close code given to the peer.
+func (c *Conn) closeWith(code int) error {
+	c.closeOnce.Do(func() {
+		msg := websocket.FormatCloseMessage(code, "")
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWait))
+		c.closeErr = c.conn.Close()
+		close(c.done)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return c.closeErr
+}
+
+// Compressed reports whether both ends sent CompressHeader during the
+// handshake, agreeing to compress the stream they carry.
+func (c *Conn) Compressed() bool { return c.compressed }
+
+// User returns the user the server authenticated the connection as.
+func (c *Conn) User() string { return c.user }
+
+// Subprotocol returns the subprotocol negotiated during the handshake.
+func (c *Conn) Subprotocol() string { return c.conn.Subprotocol() }
+
+func (c *Conn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetDeadline sets both the read and write deadlines. As with the underlying
+// WebSocket connection, a Read or Write that times out leaves the connection
+// unusable, so deadlines are meant for tearing connections down.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
@@ -0,0 +1,36 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// serveDebug serves the diagnostic pages and reports whether r asked for one.
+func serveDebug(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Path {
+	case "/hello":
+		w.Write([]byte("Hello world!"))
+		w.Write([]byte("\n"))
+	case "/ip":
+		s := []string{}
+		s = append(s, r.Header.Get("X-Real-Ip"))
+		s = append(s, r.Header.Get("X-Forwarded-For"))
+		s = append(s, r.RemoteAddr)
+		result := strings.Join(s, ", ")
+		w.Write([]byte(result))
+		w.Write([]byte("\n"))
+	case "/headers":
+		b, err := httputil.DumpRequest(r, false)
+		if err != nil {
+			w.Write([]byte("Failed to dump request!"))
+			w.Write([]byte("\n"))
+			return true
+		}
+		w.Write(b)
+		w.Write([]byte("\n"))
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package ws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Decoy returns a handler making the server look like an ordinary web site.
+// target is either the URL of a web server to reverse proxy to, such as
+// http://127.0.0.1:8080, or a directory of static files.
+func Decoy(target string) (http.Handler, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		return httputil.NewSingleHostReverseProxy(u), nil
+	}
+
+	fi, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("decoy %s is not a directory", target)
+	}
+	return http.FileServer(http.Dir(target)), nil
+}
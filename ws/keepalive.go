@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Keepalive configures how a connection keeps itself alive and detects a
+// peer that went away without closing it.
+type Keepalive struct {
+	// Interval is the time between pings. Zero sends no pings.
+	Interval time.Duration
+
+	// Timeout is how long a reader may wait for a frame, such as the pong,
+	// after a ping before the connection is closed as dead. Time nobody
+	// reads does not count. Zero does not wait for pongs.
+	Timeout time.Duration
+
+	// Idle closes the connection when no message was read or written for
+	// that long. Zero never does.
+	Idle time.Duration
+}
+
+// DefaultKeepalive pings every 30 seconds and gives up on peers not
+// answering within 30 seconds.
+var DefaultKeepalive = Keepalive{Interval: 30 * time.Second, Timeout: 30 * time.Second}
+
+// keepalive runs the pings and checks of k until c is closed. A peer counts
+// as gone only when a reader waited for it for k.Timeout after a ping
+// without reading a frame: while nobody reads, as when the consumer of c
+// stalls, frames wait unread and prove nothing.
+func (c *Conn) keepalive(k Keepalive) {
+	tick := time.Duration(0)
+	for _, d := range []time.Duration{k.Interval, k.Timeout, k.Idle} {
+		if d > 0 && (tick == 0 || d < tick) {
+			tick = d
+		}
+	}
+	if k.Interval == 0 && k.Idle == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	lastPing := time.Now()
+	var pinged time.Time // of the oldest ping without frames read since
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		now := time.Now()
+		if k.Idle > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&c.active))) >= k.Idle {
+			c.Close()
+			return
+		}
+		if !pinged.IsZero() && !time.Unix(0, atomic.LoadInt64(&c.seen)).Before(pinged) {
+			pinged = time.Time{}
+		}
+		if !pinged.IsZero() && k.Timeout > 0 {
+			if w := atomic.LoadInt64(&c.waiting); w != 0 {
+				since := time.Unix(0, w)
+				if since.Before(pinged) {
+					since = pinged
+				}
+				if now.Sub(since) >= k.Timeout {
+					log.Println("ping: no pong from", c.RemoteAddr())
+					c.Close()
+					return
+				}
+			}
+		}
+		if k.Interval == 0 || now.Sub(lastPing) < k.Interval {
+			continue
+		}
+		lastPing = now
+
+		if err := c.conn.WriteControl(websocket.PingMessage, []byte{}, now.Add(writeWait)); err != nil {
+			log.Println("ping:", err)
+			c.Close()
+			return
+		}
+		if pinged.IsZero() {
+			pinged = now
+		}
+	}
+}
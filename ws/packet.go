@@ -0,0 +1,46 @@
+package ws
+
+import (
+	"io"
+	"net"
+)
+
+// PacketConn carries one packet per message of a WebSocket connection.
+type PacketConn struct {
+	*Conn
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// NewPacketConn returns a net.PacketConn sending and receiving one packet
+// per message of c, so that packet boundaries survive the stream. Packets
+// are read from and written to the peer of c whatever the address.
+func NewPacketConn(c *Conn) *PacketConn { return &PacketConn{c} }
+
+// ReadFrom reads the next message into b. The part of the message that does
+// not fit into b is discarded.
+func (pc *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c := pc.Conn
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if c.r == nil {
+		if err := c.next(); err != nil {
+			return 0, nil, err
+		}
+	}
+	n, err := io.ReadFull(c.r, b)
+	switch err {
+	case nil: // message might be longer than b
+		_, err = io.Copy(io.Discard, c.r)
+	case io.EOF, io.ErrUnexpectedEOF:
+		err = nil
+	}
+	c.r = nil
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo sends b as one message to the peer of the connection.
+func (pc *PacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return pc.Write(b)
+}
@@ -0,0 +1,183 @@
+package ws
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// maxRefillDelay caps the delay between failing dials refilling a Pool.
+const maxRefillDelay = time.Minute
+
+type idleConn struct {
+	c     *Conn
+	since time.Time
+}
+
+// Pool keeps WebSocket connections dialed in advance, so that taking one does
+// not wait for the TCP, TLS and HTTP handshakes.
+//
+// Idle connections keep reading in the background: control messages are
+// answered and a connection closed by the peer is dropped at once. Idle
+// connections older than maxIdle are closed, so it should stay below the
+// idle timeout of the server and anything in between.
+type Pool struct {
+	dial    func() (*Conn, error)
+	size    int
+	maxIdle time.Duration
+	refill  time.Duration
+
+	mu   sync.Mutex
+	idle []idleConn // oldest first
+
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewPool returns a pool keeping size idle connections from dial. After a
+// connection is taken a replacement is dialed no sooner than refill, and the
+// delay doubles while dialing fails.
+func NewPool(dial func() (*Conn, error), size int, maxIdle, refill time.Duration) *Pool {
+	p := &Pool{
+		dial:    dial,
+		size:    size,
+		maxIdle: maxIdle,
+		refill:  refill,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go p.fill()
+	return p
+}
+
+// Get returns the most recently dialed idle connection, or dials a new one
+// if none is left.
+func (p *Pool) Get() (*Conn, error) {
+	p.mu.Lock()
+	var c *Conn
+	if n := len(p.idle); n > 0 && time.Since(p.idle[n-1].since) < p.maxIdle {
+		c = p.idle[n-1].c
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+
+	if c != nil {
+		return c, nil
+	}
+	return p.dial()
+}
+
+// Close closes the idle connections and stops refilling.
+func (p *Pool) Close() error {
+	p.once.Do(func() {
+		p.mu.Lock()
+		close(p.done)
+		idle := p.idle
+		p.idle = nil
+		p.mu.Unlock()
+
+		for _, ic := range idle {
+			ic.c.Close()
+		}
+	})
+	return nil
+}
+
+// put adds c to the idle connections and watches it until it is taken.
+func (p *Pool) put(c *Conn) {
+	p.mu.Lock()
+	select {
+	case <-p.done:
+		p.mu.Unlock()
+		c.Close()
+		return
+	default:
+	}
+	p.idle = append(p.idle, idleConn{c, time.Now()})
+	p.mu.Unlock()
+
+	go func() {
+		// Read from c like a user would. The server does not send first,
+		// so returning means c is dead, unless a user took c and got
+		// the message.
+		c.rmu.Lock()
+		err := c.next()
+		c.rmu.Unlock()
+		if err != nil {
+			p.remove(c)
+		}
+	}()
+}
+
+func (p *Pool) remove(c *Conn) {
+	p.mu.Lock()
+	for i, ic := range p.idle {
+		if ic.c == c {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+	c.Close()
+}
+
+// expire closes the connections idle for too long and returns how long the
+// oldest remaining one may stay idle, and the number of idle connections.
+func (p *Pool) expire() (time.Duration, int) {
+	p.mu.Lock()
+	var expired []*Conn
+	for len(p.idle) > 0 && time.Since(p.idle[0].since) >= p.maxIdle {
+		expired = append(expired, p.idle[0].c)
+		p.idle = p.idle[1:]
+	}
+	ttl, n := p.maxIdle, len(p.idle)
+	if n > 0 {
+		ttl -= time.Since(p.idle[0].since)
+	}
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		c.Close()
+	}
+	return ttl, n
+}
+
+func (p *Pool) fill() {
+	delay := p.refill
+	for {
+		ttl, n := p.expire()
+		if n < p.size {
+			if c, err := p.dial(); err != nil {
+				log.Println("pool:", err)
+				if delay *= 2; delay == 0 {
+					delay = time.Second
+				}
+				if delay > maxRefillDelay {
+					delay = maxRefillDelay
+				}
+			} else {
+				delay = p.refill
+				p.put(c)
+			}
+			select {
+			case <-time.After(delay):
+			case <-p.done:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-p.wake:
+		case <-time.After(ttl):
+		case <-p.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Time allowed to connect to a proxy and have it connect onwards.
+const proxyTimeout = 30 * time.Second
+
+// DialProxy connects to addr through the proxy u, an http:// URL for HTTP
+// CONNECT or a socks5:// URL, either with optional credentials, for
+// protocols other than WebSocket. Dialer.Proxy serves WebSocket servers.
+func DialProxy(u *url.URL, addr string) (net.Conn, error) {
+	if err := CheckProxy(u); err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "socks5": "1080"}[u.Scheme])
+	}
+	c, err := net.DialTimeout("tcp", host, proxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(proxyTimeout))
+	var conn net.Conn
+	if u.Scheme == "http" {
+		conn, err = connectHTTP(c, u, addr)
+	} else {
+		conn, err = connectSOCKS5(c, u, addr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("proxy %s: %v", u.Host, err)
+	}
+	c.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connectHTTP asks the HTTP proxy at the other end of c to connect to addr.
+func connectHTTP(c net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)))
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	// the body of a successful CONNECT is the tunnel: leave it unread
+	if br.Buffered() > 0 { // the target spoke first
+		return &bufferedConn{c, br}, nil
+	}
+	return c, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.br.Read(b) }
+
+// connectSOCKS5 asks the SOCKS5 proxy at the other end of c to connect to
+// addr.
+func connectSOCKS5(c net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	tgt := socks.ParseAddr(addr)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+	methods := []byte{5, 1, 0} // no authentication
+	if u.User != nil {
+		methods = []byte{5, 1, 2} // username/password
+	}
+	if _, err := c.Write(methods); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	if b[0] != 5 || b[1] != methods[2] {
+		return nil, errors.New("no acceptable authentication method")
+	}
+	if u.User != nil {
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return nil, errors.New("credentials too long")
+		}
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := c.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return nil, err
+		}
+		if b[1] != 0 {
+			return nil, errors.New("authentication failed")
+		}
+	}
+
+	if _, err := c.Write(append([]byte{5, 1, 0}, tgt...)); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return nil, err
+	}
+	if reply[1] != 0 {
+		return nil, fmt.Errorf("connect failed with code %d", reply[1])
+	}
+	if _, err := socks.ReadAddr(c); err != nil { // the bound address
+		return nil, err
+	}
+	return c, nil
+}
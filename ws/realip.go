@@ -0,0 +1,88 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIP finds the address of a client behind reverse proxies and CDNs.
+// Forwarding headers are only believed when they come from a trusted proxy,
+// since anybody else can send them.
+type RealIP struct {
+	// Trusted are the networks of the proxies in front of the server.
+	Trusted []*net.IPNet
+
+	// Headers are headers holding the client IP set by a CDN, such as
+	// CF-Connecting-IP or True-Client-IP, tried in order before
+	// X-Forwarded-For.
+	Headers []string
+}
+
+// ParseCIDRs parses a comma-separated list of CIDRs and single IPs.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (ri *RealIP) trusted(ip net.IP) bool {
+	for _, n := range ri.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address, without a port, of the client that sent
+// r. Without a trusted proxy as the peer, that is the peer itself.
+// Otherwise it is the first address of a CDN header, or the rightmost
+// address of X-Forwarded-For not belonging to a trusted proxy.
+func (ri *RealIP) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if ri == nil || peer == nil || !ri.trusted(peer) {
+		return host
+	}
+
+	for _, h := range ri.Headers {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get(h))); ip != nil {
+			return ip.String()
+		}
+	}
+
+	client := host
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break // garbage, stick to the last hop known
+		}
+		client = ip.String()
+		if !ri.trusted(ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,255 @@
+package ws
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Server upgrades HTTP requests received on Addr to WebSocket connections.
+type Server struct {
+	Addr string
+
+	// TLSConfig, when set, makes the server accept TLS (wss://) only.
+	TLSConfig *tls.Config
+
+	// Auth checks the HTTP Basic credentials of an upgrade request and
+	// returns the user they belong to, later reported by Conn.User. A nil
+	// Auth accepts every request.
+	Auth func(username, password string) (user string, ok bool)
+
+	// Path is where WebSocket upgrades are accepted. Empty means "/".
+	Path string
+
+	// Fallback serves every request that is not an authorized WebSocket
+	// upgrade on Path, so that probing the server shows an ordinary web
+	// site. A nil Fallback replies with a plain 404 Not Found, or 401
+	// Unauthorized to upgrades refused by Auth.
+	Fallback http.Handler
+
+	// Debug serves the diagnostic pages /hello, /ip and /headers, which
+	// reveal the request headers to anybody asking.
+	Debug bool
+
+	// Subprotocols are the subprotocols the server supports in order of
+	// preference. Clients asking for none of them get a connection
+	// without a subprotocol.
+	Subprotocols []string
+
+	// Compression accepts the compression of the stream offered by
+	// clients. See CompressHeader.
+	Compression bool
+
+	// Keepalive configures the pings and timeouts of connections. The zero
+	// value sends no pings and never times out.
+	Keepalive Keepalive
+
+	// RealIP finds the client address reported to Handler behind proxies.
+	// A nil RealIP reports the peer address.
+	RealIP *RealIP
+
+	// Handler is called with each upgraded connection and the address of
+	// the client.
+	Handler func(conn *Conn, remoteAddr string)
+
+	mu      sync.Mutex
+	hs      *http.Server
+	conns   map[*Conn]struct{}
+	closing bool
+}
+
+// KeyAuth returns an Auth function accepting the keys sent by clients as
+// Auth(key, ""). users maps each key to the user it belongs to.
+func KeyAuth(users map[string]string) func(username, password string) (string, bool) {
+	return func(username, _ string) (user string, ok bool) {
+		for k, u := range users { // compare with every key to not leak which one matched
+			if subtle.ConstantTimeCompare([]byte(username), []byte(k)) == 1 {
+				user, ok = u, true
+			}
+		}
+		return
+	}
+}
+
+// Authorize checks the HTTP Basic credentials of r with auth, as Server.Auth,
+// and returns the user they belong to. A nil auth accepts every request.
+func Authorize(r *http.Request, auth func(username, password string) (string, bool)) (user string, ok bool) {
+	if auth == nil {
+		return "", true
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	return auth(username, password)
+}
+
+// ServeHTTP upgrades authorized WebSocket requests on s.Path and hands the
+// rest to s.Fallback. Authorized requests whose upgrade was stripped on the
+// way get 426 Upgrade Required, telling the client that upgrades cannot
+// get through.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := s.Path
+	if path == "" {
+		path = "/"
+	}
+	if r.URL.Path == path && websocket.IsWebSocketUpgrade(r) {
+		s.upgrade(w, r)
+		return
+	}
+	if r.URL.Path == path && r.Header.Get("Sec-Websocket-Key") != "" {
+		if _, ok := Authorize(r, s.Auth); ok {
+			http.Error(w, http.StatusText(http.StatusUpgradeRequired), http.StatusUpgradeRequired)
+			return
+		}
+	}
+	if s.Debug && serveDebug(w, r) {
+		return
+	}
+	if s.Fallback != nil {
+		s.Fallback.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := s.RealIP.ClientIP(r)
+	user, ok := Authorize(r, s.Auth)
+	if !ok {
+		log.Println("rejected unauthorized request from", remoteAddr)
+		if s.Fallback != nil {
+			s.Fallback.ServeHTTP(w, r)
+		} else {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+		return
+	}
+
+	early, err := base64.RawURLEncoding.DecodeString(r.Header.Get(EarlyDataHeader))
+	if err != nil || len(early) > MaxEarlyData {
+		log.Println("rejected invalid early data from", remoteAddr)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	header := http.Header{}
+	halfClose := r.Header.Get(HalfCloseHeader) != ""
+	if halfClose {
+		header.Set(HalfCloseHeader, "1")
+	}
+	compressed := s.Compression && r.Header.Get(CompressHeader) != ""
+	if compressed {
+		header.Set(CompressHeader, "1")
+	}
+	var upgrader = websocket.Upgrader{Subprotocols: s.Subprotocols}
+	c, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	conn := newConn(c)
+	conn.user = user
+	conn.early = early
+	conn.halfClose = halfClose
+	conn.compressed = compressed
+	if !s.track(conn) {
+		conn.closeWith(websocket.CloseGoingAway)
+		return
+	}
+	go conn.keepalive(s.Keepalive)
+	s.Handler(conn, remoteAddr)
+}
+
+// track adds conn to the open connections until it is closed. It reports
+// false if the server is shutting down.
+func (s *Server) track(conn *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	conn.onClose = func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}
+	return true
+}
+
+// ListenAndServe listens on s.Addr and serves HTTP requests with s.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves HTTP requests with s. After
+// Shutdown it returns http.ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+	s.mu.Lock()
+	if s.hs == nil {
+		s.hs = &http.Server{Handler: s}
+	}
+	hs := s.hs
+	s.mu.Unlock()
+	return hs.Serve(l)
+}
+
+// Shutdown stops accepting connections and waits for the open WebSocket
+// connections to be closed by their handlers. When ctx is done first, it
+// closes the remaining ones telling the peers the server is going away.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.hs == nil {
+		s.hs = &http.Server{Handler: s}
+	}
+	hs := s.hs
+	s.mu.Unlock()
+
+	err := hs.Shutdown(ctx)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 0 {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.closeWith(websocket.CloseGoingAway)
+			}
+			return ctx.Err()
+		}
+	}
+}
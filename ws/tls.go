@@ -0,0 +1,116 @@
+package ws
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientTLSConfig returns a TLS configuration for dialing wss:// servers.
+// caFile is a PEM bundle of trusted CAs replacing the system roots,
+// serverName overrides the name sent in SNI and checked against the
+// certificate, and insecure skips verification altogether. Zero values keep
+// the defaults.
+func ClientTLSConfig(caFile, serverName string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+	}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+	return cfg, nil
+}
+
+// KeyPair is a certificate chain and private key loaded from PEM files. It
+// can be reloaded from disk while serving: new TLS handshakes get the new
+// certificate, established connections are not affected.
+type KeyPair struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of both files when loaded
+}
+
+// LoadKeyPair loads a certificate chain and private key from PEM files.
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	kp := &KeyPair{certFile: certFile, keyFile: keyFile}
+	if err := kp.Reload(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+func (kp *KeyPair) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, name := range []string{kp.certFile, kp.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// Reload loads the files again. The current certificate stays in use if
+// they cannot be loaded.
+func (kp *KeyPair) Reload() error {
+	modTime, err := kp.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return err
+	}
+
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.cert = &cert
+	kp.modTime = modTime
+	return nil
+}
+
+// ReloadIfModified reloads the files if either changed since they were last
+// loaded and reports whether it did.
+func (kp *KeyPair) ReloadIfModified() (bool, error) {
+	modTime, err := kp.lastModified()
+	if err != nil {
+		return false, err
+	}
+	kp.mu.RLock()
+	modified := !modTime.Equal(kp.modTime)
+	kp.mu.RUnlock()
+	if !modified {
+		return false, nil
+	}
+	return true, kp.Reload()
+}
+
+// GetCertificate returns the current certificate. It is meant for
+// tls.Config.GetCertificate.
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.cert, nil
+}
+
+// TLSConfig returns a TLS configuration for serving wss:// with the current
+// certificate of kp.
+func (kp *KeyPair) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: kp.GetCertificate}
+}
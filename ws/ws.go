@@ -1,173 +1,139 @@
 package ws
 
 import (
-	"bytes"
+	"crypto/tls"
 	"encoding/base64"
+	"fmt"
 	"github.com/gorilla/websocket"
-	"io"
-	"net"
 	"net/http"
-	"net/http/httputil"
-	"strings"
+	"net/url"
 
-	"log"
 	"time"
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 30 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+// Time allowed to write a ping to the peer.
+const writeWait = 30 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+const (
+	// EarlyDataHeader carries the first bytes of the stream, encoded in
+	// unpadded URL-safe base64, within the upgrade request.
+	EarlyDataHeader = "X-Early-Data"
+
+	// MaxEarlyData is the most early data a server accepts.
+	MaxEarlyData = 4096
+
+	// HalfCloseHeader is sent by clients and echoed by servers that
+	// understand CloseWrite. Connections use it only if both ends do.
+	HalfCloseHeader = "X-Half-Close"
+
+	// CompressHeader is sent by clients offering to compress the stream
+	// carried over the connection and echoed by servers accepting. The
+	// messages stay as they are: the users of both ends compress what they
+	// write, see Conn.Compressed.
+	CompressHeader = "X-Compress"
 )
 
-func Auth(username string, password string) (h http.Header) {
-	h = http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}}
-	return
+// HandshakeError is returned by Dial when the server answers the upgrade
+// request without upgrading the connection, as when the server refuses the
+// client or something on the way strips the upgrade.
+type HandshakeError struct {
+	StatusCode int // of the response
 }
 
-type Conn struct {
-	conn *websocket.Conn
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("websocket: bad handshake (%d %s)", e.StatusCode, http.StatusText(e.StatusCode))
 }
 
-// Dial: addr should be in the form of host:port
-func Dial(urlStr string, h http.Header) (conn *Conn, err error) {
-	c, _, err := websocket.DefaultDialer.Dial(urlStr, h)
-	if err != nil {
-		return
-	}
-
-	conn = &Conn{conn: c}
-
+// Auth returns a header carrying HTTP Basic credentials for Dial.
+func Auth(username string, password string) (h http.Header) {
+	h = http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}}
 	return
 }
 
-func (c *Conn) Close() error {
-	return c.conn.Close()
+// EarlyData adds data to h as the first bytes of the stream, which the
+// server reads before anything sent after the upgrade. This saves the round
+// trip of the upgrade before the server sees them. Servers not supporting
+// early data drop it.
+func EarlyData(h http.Header, data []byte) {
+	h.Set(EarlyDataHeader, base64.RawURLEncoding.EncodeToString(data))
 }
 
-func (c *Conn) Ping() {
-	ticker := time.NewTicker(pingPeriod)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			if err := c.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
-				log.Println("ping:", err)
-				return
-			}
-		}
-	}
+// A Dialer contains options for connecting to a WebSocket server.
+type Dialer struct {
+	// TLSConfig is used for wss:// URLs. A nil TLSConfig verifies the
+	// server against the system roots.
+	TLSConfig *tls.Config
+
+	// Subprotocols are offered to the server in order of preference.
+	Subprotocols []string
+
+	// Proxy is the upstream proxy to reach the server through: an http://
+	// URL for HTTP CONNECT or a socks5:// URL, either with optional
+	// credentials. A nil Proxy uses the proxy of the environment variables
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	Proxy *url.URL
+
+	// Header is sent with every upgrade request besides the header given
+	// to Dial. A Host entry replaces the host of the URL in the Host
+	// header, and a User-Agent entry the default of Go.
+	Header http.Header
+
+	// Compression offers the server to compress the stream, which it may
+	// decline. See CompressHeader.
+	Compression bool
+
+	// Keepalive configures the pings and timeouts of connections. The zero
+	// value sends no pings and never times out.
+	Keepalive Keepalive
 }
 
-func (c *Conn) WriteAddress(p []byte) (n int, err error) {
-	if err := c.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
-		log.Println("error write address:", err)
+// CheckProxy returns an error if the Dialer cannot use the proxy u.
+func CheckProxy(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "socks5":
+		return nil
 	}
-
-	return
+	return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
 }
 
-func (c Conn) Write(p []byte) (n int, err error) {
-	w, err := c.conn.NextWriter(websocket.BinaryMessage) // get a writer everytime there is a copy and close it when exit
-	if err != nil {
-		return
+// Dial connects to the server at urlStr (ws:// or wss://) and sends h with
+// the upgrade request.
+func (d *Dialer) Dial(urlStr string, h http.Header) (conn *Conn, err error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = d.TLSConfig
+	dialer.Subprotocols = d.Subprotocols
+	if d.Proxy != nil {
+		dialer.Proxy = http.ProxyURL(d.Proxy)
 	}
-	defer w.Close()
-	return w.Write(p)
-}
 
-//// p might not able to hold all data from r
-//func (c Conn) Read(p []byte) (n int, err error) {
-//	_, r, err := c.conn.NextReader()
-//	if err != nil {
-//		return
-//	}
-//	return r.Read(p)
-//}
-
-func (c Conn) ReadAddress() (r io.Reader, err error) {
-	_, p, err := c.conn.ReadMessage()
-	if err != nil {
-		return
+	merged := http.Header{HalfCloseHeader: {"1"}}
+	if d.Compression {
+		merged.Set(CompressHeader, "1")
 	}
-	r = bytes.NewReader(p)
-	return
-}
-
-func (c *Conn) ReadFrom(src net.Conn) {
-	if n, err := io.Copy(c, src); err != nil { // implicit loop in copy
-		log.Println("error copy net to ws:", n, err)
-		return
+	for k, v := range d.Header {
+		merged[k] = v
+	}
+	for k, v := range h {
+		merged[k] = v
 	}
-}
-
-func (c *Conn) WriteTo(dst net.Conn) {
-	for {
-		_, r, err := c.conn.NextReader()
-		if err != nil {
-			break
-		}
 
-		if n, err := io.Copy(dst, r); err != nil { // implicit loop in copy
-			log.Println("error write to net:", n, err)
-			break
+	c, resp, err := dialer.Dial(urlStr, merged)
+	if err != nil {
+		if err == websocket.ErrBadHandshake && resp != nil {
+			err = &HandshakeError{resp.StatusCode}
 		}
+		return
 	}
-}
 
-func ReadUserIP(r *http.Request) string {
-	IPAddress := r.Header.Get("X-Real-Ip")
-	if IPAddress == "" {
-		IPAddress = r.Header.Get("X-Forwarded-For")
-	}
-	if IPAddress == "" {
-		IPAddress = r.RemoteAddr
-	}
-	return IPAddress
+	conn = newConn(c)
+	conn.halfClose = resp.Header.Get(HalfCloseHeader) != ""
+	conn.compressed = d.Compression && resp.Header.Get(CompressHeader) != ""
+	go conn.keepalive(d.Keepalive)
+
+	return
 }
 
-func Listen(addr string, handleConnection func(conn *Conn, remoteAddr string)) {
-	http.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Hello world!"))
-		w.Write([]byte("\n"))
-	})
-	http.HandleFunc("/ip", func(w http.ResponseWriter, r *http.Request) {
-		s := []string{}
-		s = append(s, r.Header.Get("X-Real-Ip"))
-		s = append(s, r.Header.Get("X-Forwarded-For"))
-		s = append(s, r.RemoteAddr)
-		result := strings.Join(s, ", ")
-		w.Write([]byte(result))
-		w.Write([]byte("\n"))
-
-	})
-	http.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
-		b, err := httputil.DumpRequest(r, false)
-		if err != nil {
-			w.Write([]byte("Failed to dump request!"))
-			w.Write([]byte("\n"))
-			return
-		}
-		w.Write(b)
-		w.Write([]byte("\n"))
-	})
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		var upgrader = websocket.Upgrader{} // use default options
-		c, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		remoteAddr := ReadUserIP(r)
-		handleConnection(&Conn{conn: c}, remoteAddr)
-	})
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal("ListenAndServe: ", err)
-	}
+// Dial connects to the server at urlStr with the default options.
+func Dial(urlStr string, h http.Header) (*Conn, error) {
+	return (&Dialer{}).Dial(urlStr, h)
 }
@@ -0,0 +1,899 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// pipe returns both ends of a WebSocket connection served by an httptest server.
+func pipe(t *testing.T) (client, server *Conn) {
+	t.Helper()
+	ch := make(chan *Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ch <- newConn(c)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-ch
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return client, server
+}
+
+func TestConnReadAcrossMessages(t *testing.T) {
+	client, server := pipe(t)
+
+	go func() {
+		for _, s := range []string{"hello", "", ", ", "world"} {
+			server.Write([]byte(s))
+		}
+		server.Close()
+	}()
+
+	var got bytes.Buffer
+	buf := make([]byte, 3) // smaller than a message
+	for {
+		n, err := client.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got.String() != "hello, world" {
+		t.Fatalf("got %q", got.String())
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	client, server := pipe(t)
+	cp, sp := NewPacketConn(client), NewPacketConn(server)
+
+	for _, s := range []string{"first", "", "truncated packet"} {
+		if _, err := cp.WriteTo([]byte(s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 9)
+	for _, want := range []string{"first", "", "truncated"} {
+		n, addr, err := sp.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want || addr.String() != server.RemoteAddr().String() {
+			t.Fatalf("read %q from %v, want %q", buf[:n], addr, want)
+		}
+	}
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	client, _ := pipe(t)
+
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := client.Read(make([]byte, 1))
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+// serve starts s with an httptest server and returns its ws:// URL and the
+// connections s accepts.
+func serve(t *testing.T, s *Server) (string, <-chan *Conn) {
+	t.Helper()
+	ch := make(chan *Conn, 1)
+	s.Handler = func(c *Conn, _ string) { ch <- c }
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), ch
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	url, conns := serve(t, &Server{})
+	client, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-conns
+	defer client.Close()
+	defer server.Close()
+
+	client.Write([]byte("request"))
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("more")); err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("server read %q, %v", got, err)
+	}
+
+	// the other direction still flows
+	server.Write([]byte("response"))
+	server.CloseWrite()
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "response" {
+		t.Fatalf("client read %q, %v", got, err)
+	}
+}
+
+func TestCloseWriteUnsupported(t *testing.T) {
+	// a server not echoing HalfCloseHeader
+	client, _ := pipe(t)
+	if err := client.CloseWrite(); err != errors.ErrUnsupported {
+		t.Fatalf("CloseWrite to an old server: %v", err)
+	}
+
+	// a client not sending it
+	url, conns := serve(t, &Server{})
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	server := <-conns
+	defer server.Close()
+	if err := server.CloseWrite(); err != errors.ErrUnsupported {
+		t.Fatalf("CloseWrite to an old client: %v", err)
+	}
+}
+
+func TestConnAEADStream(t *testing.T) {
+	client, server := pipe(t)
+	aead, err := chacha20poly1305.New(make([]byte, chacha20poly1305.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := bytes.Repeat([]byte("shadowsocks over websocket "), 4096)
+	go func() {
+		shadowaead.NewWriter(client, aead).Write(msg)
+		client.Close()
+	}()
+
+	got, err := io.ReadAll(shadowaead.NewReader(server, aead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(msg))
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	s := &Server{
+		Auth: KeyAuth(map[string]string{"secret": "alice"}),
+		Handler: func(c *Conn, _ string) {
+			if c.User() != "alice" {
+				t.Errorf("got user %q", c.User())
+			}
+			c.Close()
+		},
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for _, h := range []http.Header{nil, Auth("wrong", "")} {
+		_, resp, err := websocket.DefaultDialer.Dial(url, h)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for %v, got %v", h, err)
+		}
+	}
+
+	c, err := Dial(url, Auth("secret", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestServerStrippedUpgrade(t *testing.T) {
+	s := &Server{Auth: KeyAuth(map[string]string{"secret": "alice"})}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// a proxy drops the hop-by-hop headers of the upgrade request
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	for key, want := range map[string]int{"secret": http.StatusUpgradeRequired, "wrong": http.StatusNotFound} {
+		req.SetBasicAuth(key, "")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("key %q: got %s, want %d", key, resp.Status, want)
+		}
+	}
+
+	// Dial reports the status
+	_, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), Auth("wrong", ""))
+	if he, ok := err.(*HandshakeError); !ok || he.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got %v, want a handshake error with 401", err)
+	}
+}
+
+func TestEarlyData(t *testing.T) {
+	got := make(chan string, 1)
+	s := &Server{Handler: func(c *Conn, _ string) {
+		b, _ := io.ReadAll(c)
+		got <- string(b)
+	}}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	h := http.Header{}
+	EarlyData(h, make([]byte, MaxEarlyData+1))
+	if _, resp, err := websocket.DefaultDialer.Dial(url, h); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for too much early data, got %v", err)
+	}
+
+	EarlyData(h, []byte("early, "))
+	c, err := Dial(url, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("late"))
+	c.Close()
+	if s := <-got; s != "early, late" {
+		t.Fatalf("read %q", s)
+	}
+}
+
+// connectProxy serves HTTP CONNECT requests with the credentials u:p,
+// counting the connections it relays.
+func connectProxy(t *testing.T, connects *int32) *url.URL {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != Auth("u", "p").Get("Authorization") {
+			http.Error(w, "denied", http.StatusProxyAuthRequired)
+			return
+		}
+		atomic.AddInt32(connects, 1)
+		up, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		c, brw, _ := w.(http.Hijacker).Hijack()
+		go func() { io.Copy(up, brw); up.Close() }()
+		io.Copy(c, up)
+		c.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	pu, _ := url.Parse(proxy.URL)
+	pu.User = url.UserPassword("u", "p")
+	return pu
+}
+
+func TestDialProxy(t *testing.T) {
+	srv := httptest.NewServer(&Server{Handler: func(c *Conn, _ string) { io.Copy(c, c) }})
+	defer srv.Close()
+
+	var connects int32
+	d := &Dialer{Proxy: connectProxy(t, &connects)}
+	c, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hi" || atomic.LoadInt32(&connects) != 1 {
+		t.Fatalf("read %q, %v after %d CONNECTs", buf, err, connects)
+	}
+}
+
+// socks5Proxy serves SOCKS5 CONNECT requests with username/password
+// authentication as user and pass, counting the connections it relays.
+func socks5Proxy(t *testing.T, user, pass string, connects *int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(c net.Conn) error {
+		defer c.Close()
+		br := bufio.NewReader(c)
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(br, b); err != nil || b[0] != 5 {
+			return fmt.Errorf("bad greeting %v: %v", b, err)
+		}
+		methods := make([]byte, b[1])
+		io.ReadFull(br, methods)
+		if bytes.IndexByte(methods, 2) < 0 {
+			c.Write([]byte{5, 0xff})
+			return errors.New("no username/password method offered")
+		}
+		c.Write([]byte{5, 2})
+
+		field := func() string {
+			n, _ := br.ReadByte()
+			f := make([]byte, n)
+			io.ReadFull(br, f)
+			return string(f)
+		}
+		br.ReadByte() // version of the subnegotiation
+		if u, p := field(), field(); u != user || p != pass {
+			c.Write([]byte{1, 1})
+			return nil
+		}
+		c.Write([]byte{1, 0})
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(br, req); err != nil || req[1] != 1 {
+			return fmt.Errorf("bad request %v: %v", req, err)
+		}
+		var host string
+		switch req[3] {
+		case 1, 4:
+			ip := make(net.IP, map[byte]int{1: 4, 4: 16}[req[3]])
+			io.ReadFull(br, ip)
+			host = ip.String()
+		case 3:
+			host = field()
+		}
+		port := make([]byte, 2)
+		io.ReadFull(br, port)
+		up, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+		if err != nil {
+			c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return err
+		}
+		defer up.Close()
+		atomic.AddInt32(connects, 1)
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go func() { io.Copy(up, br); up.Close() }()
+		io.Copy(c, up)
+		return nil
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if err := serve(c); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestDialSOCKS5Proxy(t *testing.T) {
+	srv := httptest.NewServer(&Server{Handler: func(c *Conn, _ string) { io.Copy(c, c) }})
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	var connects int32
+	proxy := socks5Proxy(t, "u", "p", &connects)
+
+	d := &Dialer{Proxy: &url.URL{Scheme: "socks5", Host: proxy.Addr().String(), User: url.UserPassword("u", "wrong")}}
+	if _, err := d.Dial(wsURL, nil); err == nil {
+		t.Fatal("dialed through the proxy with a wrong password")
+	}
+
+	d.Proxy.User = url.UserPassword("u", "p")
+	c, err := d.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hi" || atomic.LoadInt32(&connects) != 1 {
+		t.Fatalf("read %q, %v after %d CONNECTs", buf, err, atomic.LoadInt32(&connects))
+	}
+}
+
+func TestDialProxyTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	var connects int32
+	for _, proxy := range []*url.URL{
+		connectProxy(t, &connects),
+		{Scheme: "socks5", Host: socks5Proxy(t, "u", "p", &connects).Addr().String(), User: url.UserPassword("u", "p")},
+	} {
+		c, err := DialProxy(proxy, l.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %v", proxy.Scheme, err)
+		}
+		c.Write([]byte("hi"))
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hi" {
+			t.Fatalf("%s: read %q, %v", proxy.Scheme, buf, err)
+		}
+		c.Close()
+
+		proxy.User = url.UserPassword("u", "wrong")
+		if _, err := DialProxy(proxy, l.Addr().String()); err == nil {
+			t.Fatalf("%s: dialed with a wrong password", proxy.Scheme)
+		}
+	}
+	if n := atomic.LoadInt32(&connects); n != 2 {
+		t.Fatalf("%d connections relayed, want 2", n)
+	}
+}
+
+func TestDialerHeader(t *testing.T) {
+	reqs := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs <- r
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err == nil {
+			c.Close()
+		}
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Header: http.Header{
+		"Host":       {"front.example"},
+		"User-Agent": {"test/1.0"},
+		"X-Extra":    {"1"},
+	}}
+	c, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), Auth("key", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	r := <-reqs
+	if r.Host != "front.example" || r.UserAgent() != "test/1.0" || r.Header.Get("X-Extra") != "1" || r.Header.Get("Authorization") == "" {
+		t.Fatalf("got Host %q and header %v", r.Host, r.Header)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, tc := range []struct {
+		offer, accept, want bool
+	}{
+		{false, false, false},
+		{true, false, false},
+		{false, true, false},
+		{true, true, true},
+	} {
+		s := &Server{Compression: tc.accept}
+		url, conns := serve(t, s)
+		c, err := (&Dialer{Compression: tc.offer}).Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := <-conns
+		if c.Compressed() != tc.want || sc.Compressed() != tc.want {
+			t.Errorf("offered %v, accepted %v: client %v, server %v", tc.offer, tc.accept, c.Compressed(), sc.Compressed())
+		}
+		c.Close()
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParseCIDRs("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ri := &RealIP{Trusted: trusted, Headers: []string{"CF-Connecting-IP"}}
+
+	for _, tc := range []struct {
+		peer, xff, cdn, want string
+	}{
+		{"203.0.113.9:1234", "1.2.3.4", "", "203.0.113.9"}, // untrusted peer
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "1.2.3.4, 5.6.7.8, 192.0.2.7", "", "5.6.7.8"}, // spoofed 1.2.3.4
+		{"10.0.0.1:1234", "10.1.1.1, 10.2.2.2", "", "10.1.1.1"},
+		{"10.0.0.1:1234", "5.6.7.8, junk, 10.2.2.2", "", "10.2.2.2"},
+		{"10.0.0.1:1234", "5.6.7.8", "2001:db8::1", "2001:db8::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.peer
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.cdn != "" {
+			r.Header.Set("CF-Connecting-IP", tc.cdn)
+		}
+		if got := ri.ClientIP(r); got != tc.want {
+			t.Errorf("%s with %q: got %s, want %s", tc.peer, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestServerFallback(t *testing.T) {
+	s := &Server{
+		Path:     "/tunnel",
+		Auth:     KeyAuth(map[string]string{"secret": ""}),
+		Fallback: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("decoy")) }),
+		Handler:  func(c *Conn, _ string) { c.Close() },
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for _, path := range []string{"/", "/tunnel", "/headers"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "decoy" {
+			t.Fatalf("GET %s: got %q", path, b)
+		}
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	if _, _, err := websocket.DefaultDialer.Dial(url+"/tunnel", nil); err == nil {
+		t.Fatal("upgraded unauthorized request")
+	}
+	if _, err := Dial(url+"/", Auth("secret", "")); err == nil {
+		t.Fatal("upgraded request on wrong path")
+	}
+	c, err := Dial(url+"/tunnel", Auth("secret", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestKeepalive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if r.URL.Path == "/deaf" { // never reads, so never answers pings
+			time.Sleep(2 * time.Second)
+			return
+		}
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for _, tc := range []struct {
+		path string
+		k    Keepalive
+	}{
+		{"/deaf", Keepalive{Interval: 50 * time.Millisecond, Timeout: 100 * time.Millisecond}},
+		{"/idle", Keepalive{Interval: 50 * time.Millisecond, Timeout: time.Second, Idle: 200 * time.Millisecond}},
+	} {
+		d := &Dialer{Keepalive: tc.k}
+		c, err := d.Dial(url+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		c.SetReadDeadline(start.Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err == nil || time.Since(start) >= time.Second {
+			t.Errorf("%s: connection not closed after %v: %v", tc.path, time.Since(start), err)
+		}
+		c.Close()
+	}
+}
+
+func TestKeepaliveStalledReader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		go func() { // answers pings
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		for i := 0; i < 10; i++ {
+			c.WriteMessage(websocket.BinaryMessage, []byte{byte(i)})
+			time.Sleep(20 * time.Millisecond)
+		}
+		time.Sleep(time.Second)
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Keepalive: Keepalive{Interval: 50 * time.Millisecond, Timeout: 100 * time.Millisecond}}
+	c, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// pongs wait behind unread messages while the consumer stalls
+	time.Sleep(500 * time.Millisecond)
+	b := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(b); err != nil || b[0] != byte(i) {
+			t.Fatalf("read %d, %v after stalling, want %d", b[0], err, i)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := &Server{Handler: func(c *Conn, _ string) {
+		go func() {
+			io.Copy(c, c)
+			c.Close()
+		}()
+	}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	url := "ws://" + l.Addr().String()
+
+	quick, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	time.AfterFunc(100*time.Millisecond, func() { quick.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("Shutdown returned after %v", d)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	slow.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := slow.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF after shutdown, got %v", err)
+	}
+	if _, err := Dial(url, nil); err == nil {
+		t.Fatal("dialed after shutdown")
+	}
+}
+
+// selfSigned writes a self-signed certificate for host and its key to dir
+// and returns the paths of both files.
+func selfSigned(t *testing.T, dir, host string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// serveTLS starts s on a loopback port and returns its wss:// URL.
+func serveTLS(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	return "wss://" + l.Addr().String() + "/"
+}
+
+func TestTLS(t *testing.T) {
+	certFile, keyFile := selfSigned(t, t.TempDir(), "example.test")
+	kp, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := serveTLS(t, &Server{
+		TLSConfig: kp.TLSConfig(),
+		Handler: func(c *Conn, _ string) {
+			c.Write([]byte("hi"))
+			c.Close()
+		},
+	})
+
+	for _, tt := range []struct {
+		name       string
+		caFile     string
+		serverName string
+		insecure   bool
+		ok         bool
+	}{
+		{"system roots", "", "", false, false},
+		{"custom CA without SNI", certFile, "", false, false},
+		{"custom CA", certFile, "example.test", false, true},
+		{"insecure", "", "", true, true},
+	} {
+		tlsConfig, err := ClientTLSConfig(tt.caFile, tt.serverName, tt.insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := (&Dialer{TLSConfig: tlsConfig}).Dial(url, nil)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%s: got error %v", tt.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		if b, err := io.ReadAll(c); err != nil || string(b) != "hi" {
+			t.Fatalf("%s: read %q, %v", tt.name, b, err)
+		}
+		c.Close()
+	}
+}
+
+func TestKeyPairReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := selfSigned(t, dir, "old.test")
+	kp, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := make(chan struct{})
+	url := serveTLS(t, &Server{
+		TLSConfig: kp.TLSConfig(),
+		Handler: func(c *Conn, _ string) {
+			<-block
+			c.Write([]byte("still here"))
+			c.Close()
+		},
+	})
+	dial := func(host string) (*Conn, error) {
+		tlsConfig, err := ClientTLSConfig(certFile, host, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return (&Dialer{TLSConfig: tlsConfig}).Dial(url, nil)
+	}
+
+	old, err := dial("old.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if modified, err := kp.ReloadIfModified(); modified || err != nil {
+		t.Fatalf("reloaded unmodified files: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond) // let the modification time move on
+	selfSigned(t, dir, "new.test")
+	if modified, err := kp.ReloadIfModified(); !modified || err != nil {
+		t.Fatalf("did not reload modified files: %v", err)
+	}
+
+	c, err := dial("new.test") // the CA file now holds the new certificate
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(block)
+	c.Close()
+
+	if b, err := io.ReadAll(old); err != nil || string(b) != "still here" {
+		t.Fatalf("existing connection: read %q, %v", b, err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	conns := make(chan *Conn, 16)
+	srv := httptest.NewServer(&Server{Handler: func(c *Conn, _ string) { conns <- c }})
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	p := NewPool(func() (*Conn, error) { return Dial(url, nil) }, 2, time.Hour, time.Millisecond)
+	defer p.Close()
+	first, second := <-conns, <-conns
+
+	// a connection closed by the server while idle is replaced
+	first.Close()
+	third := <-conns
+
+	c, err := p.Get() // handshaken already, no dial
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	for _, s := range []*Conn{second, third} {
+		s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := io.ReadFull(s, buf); err == nil {
+			if string(buf) != "hi" {
+				t.Fatalf("read %q", buf)
+			}
+			return
+		}
+	}
+	t.Fatal("pooled connection did not reach the server")
+}
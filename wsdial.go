@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+// wsDialer returns a dialer for the WebSocket server at u set up from the
+// client flags.
+func wsDialer(u *url.URL) (*ws.Dialer, error) {
+	d := &ws.Dialer{Compression: config.Compress, Keepalive: config.Keepalive}
+	if u.Scheme == "wss" {
+		tlsConfig, err := ws.ClientTLSConfig(config.TLSCA, config.TLSServerName, config.TLSInsecure)
+		if err != nil {
+			return nil, err
+		}
+		d.TLSConfig = tlsConfig
+	}
+	proxy, err := clientProxy()
+	if err != nil {
+		return nil, err
+	}
+	d.Proxy = proxy
+	d.Header = clientHeader()
+	return d, nil
+}
+
+// clientProxy returns the upstream proxy of -proxy, nil if none.
+func clientProxy() (*url.URL, error) {
+	if config.Proxy == "" {
+		return nil, nil
+	}
+	proxy, err := url.Parse(config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	if err := ws.CheckProxy(proxy); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// clientHeader returns the header of -header, -ws-host and -user-agent for
+// the requests to servers.
+func clientHeader() http.Header {
+	h := http.Header{}
+	for k, v := range config.Header {
+		h[k] = v
+	}
+	if config.Host != "" {
+		h.Set("Host", config.Host)
+	}
+	if config.UserAgent != "" {
+		h.Set("User-Agent", config.UserAgent)
+	}
+	return h
+}
+
+// headerFlag collects the header lines "Name: value" of a repeated flag.
+type headerFlag http.Header
+
+func (f headerFlag) String() string {
+	var lines []string
+	for k, vs := range f {
+		for _, v := range vs {
+			lines = append(lines, k+": "+v)
+		}
+	}
+	return strings.Join(lines, ", ")
+}
+
+func (f headerFlag) Set(line string) error {
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return fmt.Errorf("header %q is not of the form Name: value", line)
+	}
+	http.Header(f).Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	return nil
+}
+
+// wsClient is the transport.Dialer of WebSocket servers with URLs such as
+// ws://key@host:port/path. The mode of a connection is its subprotocol.
+type wsClient struct {
+	url    string // server URL without the key
+	key    string
+	dialer *ws.Dialer
+
+	poolOnce sync.Once
+	pool     *ws.Pool // of connections in ModeStream, with -pool
+
+	fallback *pollClient // with -fallback
+
+	mu      sync.Mutex
+	retry   time.Time     // when to try upgrades again while polling, guarded by mu
+	backoff time.Duration // of the next fall back, guarded by mu
+}
+
+// Time to use HTTP long polling after a WebSocket upgrade failed before
+// trying again, doubling with every failure in a row up to maxPollBackoff.
+const (
+	minPollBackoff = 30 * time.Second
+	maxPollBackoff = 30 * time.Minute
+)
+
+func dialWS(u *url.URL) (transport.Dialer, error) {
+	urlStr := fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, u.Path)
+	d, err := wsDialer(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure dialer for %s: %v", urlStr, err)
+	}
+	w := &wsClient{url: urlStr, key: u.User.Username(), dialer: d}
+	if config.Fallback {
+		pc, err := dialPoll(u)
+		if err != nil {
+			return nil, err
+		}
+		w.fallback = pc.(*pollClient)
+	}
+	return w, nil
+}
+
+// Dial connects to the server in mode. Connections in ModeStream come from
+// the pool with -pool.
+func (w *wsClient) Dial(mode string) (net.Conn, error) {
+	if w.polling() {
+		return w.fallback.Dial(mode)
+	}
+	if mode == transport.ModeStream && config.Pool > 0 {
+		w.poolOnce.Do(func() {
+			w.pool = ws.NewPool(func() (*ws.Conn, error) { return w.dial(mode, nil) }, config.Pool, config.PoolIdle, config.PoolRefill)
+		})
+		c, err := w.conn(w.pool.Get())
+		if w.fallBack(err) {
+			return w.fallback.Dial(mode)
+		}
+		if err == nil {
+			w.upgraded()
+		}
+		return c, err
+	}
+	return w.DialEarly(mode, nil)
+}
+
+// DialEarly is like Dial but sends early, if not empty, as early data of the
+// upgrade request.
+func (w *wsClient) DialEarly(mode string, early []byte) (net.Conn, error) {
+	if w.polling() {
+		return w.pollEarly(mode, early)
+	}
+	c, err := w.conn(w.dial(mode, early))
+	if w.fallBack(err) {
+		return w.pollEarly(mode, early)
+	}
+	if err == nil {
+		w.upgraded()
+	}
+	return c, err
+}
+
+// polling reports whether to use HTTP long polling instead of trying an
+// upgrade.
+func (w *wsClient) polling() bool {
+	if w.fallback == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Now().Before(w.retry)
+}
+
+// fallBack reports whether to fall back to HTTP long polling after an
+// upgrade failed with err, which it does for a while when something on the
+// way blocked the upgrade, see upgradeBlocked.
+func (w *wsClient) fallBack(err error) bool {
+	if w.fallback == nil || !upgradeBlocked(err) {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if time.Now().Before(w.retry) { // fell back already
+		return true
+	}
+	if w.backoff == 0 {
+		w.backoff = minPollBackoff
+	}
+	w.retry = time.Now().Add(w.backoff)
+	logf("WebSocket upgrade to %s failed (%v), falling back to HTTP long polling for %v", w.url, err, w.backoff)
+	if w.backoff *= 2; w.backoff > maxPollBackoff {
+		w.backoff = maxPollBackoff
+	}
+	return true
+}
+
+// upgraded resets the backoff of fallBack after an upgrade succeeded.
+func (w *wsClient) upgraded() {
+	if w.fallback == nil {
+		return
+	}
+	w.mu.Lock()
+	w.backoff = 0
+	w.mu.Unlock()
+}
+
+// pollEarly opens a long polling session sending early first.
+func (w *wsClient) pollEarly(mode string, early []byte) (net.Conn, error) {
+	c, err := w.fallback.Dial(mode)
+	if err != nil || len(early) == 0 {
+		return c, err
+	}
+	if _, err := c.Write(early); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// upgradeBlocked reports whether err tells that the upgrade request reached
+// something answering without upgrading, or cutting the connection during
+// the handshake. Our servers refuse the client with 401 and unknown paths
+// with 404, which are not worth polling, but never answer 403: that comes
+// from a middlebox. Failures to connect at all are not blocked upgrades.
+func upgradeBlocked(err error) bool {
+	var he *ws.HandshakeError
+	if errors.As(err, &he) {
+		switch he.StatusCode {
+		case http.StatusSwitchingProtocols, http.StatusUnauthorized, http.StatusNotFound:
+			return false
+		}
+		return true
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+func (w *wsClient) conn(c *ws.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	if c.Subprotocol() == transport.ModePacket {
+		return ws.NewPacketConn(c), nil
+	}
+	return c, nil
+}
+
+func (w *wsClient) dial(mode string, early []byte) (*ws.Conn, error) {
+	d := *w.dialer
+	if mode != transport.ModeStream {
+		d.Subprotocols = []string{mode}
+	}
+	h := ws.Auth(w.key, "")
+	if len(early) > 0 {
+		ws.EarlyData(h, early)
+		d.Compression = false // early data goes out before the server agrees
+	}
+	conn, err := d.Dial(w.url, h)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Subprotocol() != mode {
+		conn.Close()
+		return nil, fmt.Errorf("server does not support %s", mode)
+	}
+	return conn, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BigSully/shadowsocks-ws/poll"
+	"github.com/BigSully/shadowsocks-ws/transport"
+)
+
+// strippingProxy starts a reverse proxy to the server at addr which drops
+// the upgrade of WebSocket requests while strip is set.
+func strippingProxy(t *testing.T, addr string, strip *int32) string {
+	target := &url.URL{Scheme: "http", Host: addr}
+	rp := httputil.NewSingleHostReverseProxy(target)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		if atomic.LoadInt32(strip) == 1 {
+			r.Header.Del("Upgrade")
+			r.Header.Del("Connection")
+		}
+	}
+	ts := httptest.NewServer(rp)
+	t.Cleanup(ts.Close)
+	return strings.TrimPrefix(ts.URL, "http://")
+}
+
+func TestWSFallback(t *testing.T) {
+	l, err := transport.Listen("http://127.0.0.1:0/p", map[string]string{"key": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	strip := int32(1)
+	proxy := strippingProxy(t, l.Addr().String(), &strip)
+
+	config.Fallback = true
+	defer func() { config.Fallback = false }()
+	d, err := transport.NewDialer("ws://key@" + proxy + "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := d.(*wsClient)
+	echo := func() net.Conn {
+		t.Helper()
+		c, err := w.Dial(transport.ModeStream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+			t.Fatalf("echo %q, %v", b, err)
+		}
+		return c
+	}
+
+	// the stripped upgrade falls back to polling
+	if c := echo(); !isPoll(c) || !w.polling() {
+		t.Fatalf("dialed %T while upgrades are stripped", c)
+	}
+	// until the backoff is over
+	atomic.StoreInt32(&strip, 0)
+	if c := echo(); !isPoll(c) {
+		t.Fatalf("dialed %T during the backoff", c)
+	}
+	w.mu.Lock()
+	w.retry = time.Time{}
+	w.mu.Unlock()
+	if c := echo(); isPoll(c) || w.polling() {
+		t.Fatalf("dialed %T once upgrades get through again", c)
+	}
+	if w.backoff != 0 {
+		t.Fatalf("backoff %v after an upgrade", w.backoff)
+	}
+
+	// a refused key is no reason to poll
+	d, err = transport.NewDialer("ws://wrong@" + proxy + "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Dial(transport.ModeStream); err == nil || d.(*wsClient).polling() {
+		t.Fatalf("wrong key dialed with %v", err)
+	}
+}
+
+// blockingProxy starts a reverse proxy to the server at addr which handles
+// WebSocket requests with block instead.
+func blockingProxy(t *testing.T, addr string, block http.HandlerFunc) string {
+	rp := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: addr})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			block(w, r)
+			return
+		}
+		rp.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return strings.TrimPrefix(ts.URL, "http://")
+}
+
+func TestWSFallbackBlocked(t *testing.T) {
+	l, err := transport.Listen("http://127.0.0.1:0/p", map[string]string{"key": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	config.Fallback = true
+	defer func() { config.Fallback = false }()
+
+	for _, tc := range []struct {
+		name  string
+		block http.HandlerFunc
+	}{
+		{"403", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "<html>Access denied by policy</html>", http.StatusForbidden)
+		}},
+		{"reset", func(w http.ResponseWriter, r *http.Request) {
+			c, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			c.(*net.TCPConn).SetLinger(0)
+			c.Close()
+		}},
+	} {
+		proxy := blockingProxy(t, l.Addr().String(), tc.block)
+		d, err := transport.NewDialer("ws://key@" + proxy + "/p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.Dial(transport.ModeStream)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+			t.Fatalf("%s: echo %q, %v", tc.name, b, err)
+		}
+		if !isPoll(c) {
+			t.Fatalf("%s: dialed %T", tc.name, c)
+		}
+		c.Close()
+	}
+
+	// a server down is no reason to poll
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	d, err := transport.NewDialer("ws://key@" + down.Addr().String() + "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Dial(transport.ModeStream); err == nil || d.(*wsClient).polling() {
+		t.Fatalf("dial of a closed port: %v", err)
+	}
+}
+
+func isPoll(c net.Conn) bool {
+	_, ok := c.(*poll.Conn)
+	return ok
+}
+
+func TestWSNoPolling(t *testing.T) {
+	l, err := transport.Listen("ws://127.0.0.1:0/p", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// ws:// servers do not serve polling sessions
+	_, err = (&poll.Dialer{}).Dial("http://"+l.Addr().String()+"/p", transport.ModeStream, nil)
+	if err == nil {
+		t.Fatal("polling session with a ws:// server")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/BigSully/shadowsocks-ws/poll"
+	"github.com/BigSully/shadowsocks-ws/transport"
+	"github.com/BigSully/shadowsocks-ws/ws"
+)
+
+func init() {
+	transport.Register("ws", dialWS, listenWS)
+	transport.Register("wss", dialWS, listenWS)
+	transport.Register("http", dialPoll, listenWS)
+	transport.Register("https", dialPoll, listenWS)
+}
+
+// wsListener is the transport.Listener of a WebSocket server, which serves
+// HTTP long polling at the same path for http:// and https:// URLs.
+type wsListener struct {
+	*transport.Queue
+	srv  *ws.Server
+	poll *poll.Server // nil for ws:// and wss:// URLs
+	l    net.Listener
+}
+
+func listenWS(u *url.URL, users map[string]string) (transport.Listener, error) {
+	srv := &ws.Server{
+		Addr:         u.Host,
+		Path:         u.Path,
+		Debug:        config.WSDebug,
+		Compression:  config.Compress,
+		Keepalive:    config.Keepalive,
+		Subprotocols: []string{transport.ModeMux, transport.ModePacket},
+	}
+	if config.Decoy != "" {
+		fallback, err := ws.Decoy(config.Decoy)
+		if err != nil {
+			return nil, err
+		}
+		srv.Fallback = fallback
+	}
+	var ps *poll.Server
+	if u.Scheme == "http" || u.Scheme == "https" { // long polling is opt-in
+		ps = &poll.Server{
+			Path:     u.Path,
+			Modes:    srv.Subprotocols,
+			Fallback: srv.Fallback,
+		}
+		srv.Fallback = ps
+	}
+	if u.Scheme == "wss" || u.Scheme == "https" {
+		kp, err := ws.LoadKeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		go watchKeyPair(kp)
+		srv.TLSConfig = kp.TLSConfig()
+	}
+	if len(users) > 0 {
+		srv.Auth = ws.KeyAuth(users)
+	} else {
+		logf("no client keys configured, accepting all WebSocket clients")
+	}
+	if config.TrustedProxies != nil || len(config.RealIPHeaders) > 0 {
+		srv.RealIP = &ws.RealIP{Trusted: config.TrustedProxies, Headers: config.RealIPHeaders}
+	}
+
+	l, err := listenShared(u.Host, kindHTTP)
+	if err != nil {
+		return nil, err
+	}
+
+	wl := &wsListener{Queue: transport.NewQueue(), srv: srv, poll: ps, l: l}
+	srv.Handler = func(c *ws.Conn, remoteAddr string) {
+		var conn net.Conn = c
+		if c.Subprotocol() == transport.ModePacket {
+			conn = ws.NewPacketConn(c)
+		}
+		wl.Put(transport.Accepted(conn, c.User(), c.Subprotocol(), remoteAddr))
+	}
+	if ps != nil {
+		ps.Auth = srv.Auth
+		ps.RealIP = srv.RealIP
+		ps.Handler = func(c *poll.Conn, remoteAddr string) {
+			var conn net.Conn = c
+			if c.Mode() == transport.ModePacket {
+				conn = transport.NewPacketConn(c)
+			}
+			wl.Put(transport.Accepted(conn, c.User(), c.Mode(), remoteAddr))
+		}
+	}
+	go func() {
+		err := srv.Serve(l)
+		if err == http.ErrServerClosed {
+			err = transport.ErrClosed
+		}
+		wl.Stop(err)
+	}()
+	return wl, nil
+}
+
+func (l *wsListener) Close() error {
+	l.Stop(transport.ErrClosed)
+	return l.l.Close()
+}
+
+func (l *wsListener) Addr() net.Addr { return l.l.Addr() }
+
+// Shutdown stops the server gracefully, see ws.Server.Shutdown and
+// poll.Server.Shutdown.
+func (l *wsListener) Shutdown(ctx context.Context) error {
+	if l.poll == nil {
+		return l.srv.Shutdown(ctx)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- l.poll.Shutdown(ctx) }()
+	err := l.srv.Shutdown(ctx)
+	if perr := <-errc; err == nil {
+		err = perr
+	}
+	return err
+}